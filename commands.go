@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	. "github.com/izacus/PrometPush/src"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errUsage is returned by commands called with invalid arguments, after they printed the usage.
+var errUsage = errors.New("invalid arguments")
+
+func openDatabase() error {
+	if err := OpenDbConnection(); err != nil {
+		return fmt.Errorf("failed to connect to database: %v", err)
+	}
+
+	return nil
+}
+
+// migrate handles "migrate up|down|status".
+func migrate(args []string) error {
+	if len(args) != 1 {
+		flag.Usage()
+		return errUsage
+	}
+
+	if err := openDatabase(); err != nil {
+		return err
+	}
+	defer GetDbConnection().Close()
+
+	switch args[0] {
+	case "up":
+		if err := MigrateDatabase(); err != nil {
+			return fmt.Errorf("migration failed: %v", err)
+		}
+
+		log.Info("Database is up to date.")
+	case "down":
+		if err := RollbackDatabase(); err != nil {
+			return fmt.Errorf("rollback failed: %v", err)
+		}
+
+		log.Info("Last migration rolled back.")
+	case "status":
+		states, err := MigrationStatus()
+		if err != nil {
+			return fmt.Errorf("failed to read migration status: %v", err)
+		}
+
+		for _, state := range states {
+			status := "pending"
+			if state.Applied {
+				status = "applied"
+			}
+
+			fmt.Printf("%s\t%s\n", state.ID, status)
+		}
+	default:
+		flag.Usage()
+		return errUsage
+	}
+
+	return nil
+}
+
+// fetchOnce runs a single fetch of events and cameras and prints the results as JSON. Fetched data is
+// stored, so unless a database is passed with --db-dsn, a scratch database is used instead of the configured one.
+func fetchOnce() error {
+	if len(dbDsnOverride) == 0 {
+		dir, err := ioutil.TempDir("", "promet_push")
+		if err != nil {
+			return fmt.Errorf("failed to create scratch database: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		cfg := *GetConfiguration()
+		cfg.Db.Driver = "sqlite3"
+		cfg.Db.Dsn = filepath.Join(dir, "fetch-once.db")
+		SetConfiguration(&cfg)
+		log.WithField("dsn", cfg.Db.Dsn).Info("Using a scratch database, all events will be reported as new.")
+	}
+
+	if err := InitializeDbConnection(); err != nil {
+		return fmt.Errorf("failed to connect to database: %v", err)
+	}
+	defer GetDbConnection().Close()
+
+	ctx := context.Background()
+	eventIdsChannel := make(chan []string, 1)
+	eventsChannel := make(chan []Dogodek, 1)
+	camerasChannel := make(chan []Camera, 1)
+
+	ParseTrafficEvents(ctx, eventIdsChannel, eventsChannel)
+	ParseTrafficCameras(ctx, camerasChannel)
+
+	var result struct {
+		NewEventIds []string  `json:"new_event_ids"`
+		Events      []Dogodek `json:"events"`
+		Cameras     []Camera  `json:"cameras"`
+	}
+
+	select {
+	case result.NewEventIds = <-eventIdsChannel:
+		result.Events = <-eventsChannel
+	default:
+		log.Error("Failed to fetch events.")
+	}
+
+	select {
+	case result.Cameras = <-camerasChannel:
+	default:
+		log.Error("Failed to fetch cameras.")
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
+
+// sendTestPush handles "send-test-push --token <token>".
+func sendTestPush(args []string) error {
+	flags := flag.NewFlagSet("send-test-push", flag.ContinueOnError)
+	token := flags.String("token", "", "Device registration token")
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+
+	if len(*token) == 0 || flags.NArg() > 0 {
+		flags.Usage()
+		return errUsage
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	client, err := NewMessagingClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to initialize firebase client: %v", err)
+	}
+
+	id, err := SendTestPush(ctx, client, *token)
+	if err != nil {
+		return fmt.Errorf("failed to send test push: %v", err)
+	}
+
+	fmt.Println(id)
+	return nil
+}
+
+// tokens handles "tokens list|prune".
+func tokens(args []string) error {
+	if len(args) != 1 {
+		flag.Usage()
+		return errUsage
+	}
+
+	if err := openDatabase(); err != nil {
+		return err
+	}
+
+	db := GetDbConnection()
+	defer db.Close()
+
+	switch args[0] {
+	case "list":
+		keys, err := ListApiKeys(db)
+		if err != nil {
+			return fmt.Errorf("failed to list tokens: %v", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tREGISTERED\tUSER AGENT\tTOKEN")
+		for _, key := range keys {
+			registered := time.Unix(key.RegistrationTime, 0).Format(time.RFC3339)
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", key.Id, registered, key.UserAgent, key.Key)
+		}
+		w.Flush()
+	case "prune":
+		ctx := context.Background()
+		client, err := NewMessagingClient(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to initialize firebase client: %v", err)
+		}
+
+		removed, err := PruneApiKeys(ctx, db, client)
+		if err != nil {
+			return fmt.Errorf("failed to prune tokens after removing %d: %v", removed, err)
+		}
+
+		fmt.Printf("Removed %d tokens.\n", removed)
+	default:
+		flag.Usage()
+		return errUsage
+	}
+
+	return nil
+}
@@ -15,6 +15,7 @@ require (
 	github.com/robfig/cron v1.2.0
 	github.com/scalingdata/gcfg v0.0.0-20140729183856-37aabad69cfd
 	github.com/sirupsen/logrus v1.4.2
+	golang.org/x/sync v0.0.0-20200317015054-43a5402ce75a
 	google.golang.org/api v0.26.0
 	gopkg.in/gormigrate.v1 v1.6.0
 )
@@ -1,52 +1,92 @@
 package main
 
 import (
-	"net/http"
+	"errors"
+	"flag"
+	"fmt"
 	"os"
-	"time"
 
 	. "github.com/izacus/PrometPush/src"
 
-	"github.com/getsentry/sentry-go"
-	"github.com/julienschmidt/httprouter"
-	"github.com/robfig/cron"
-	"github.com/scalingdata/gcfg"
 	log "github.com/sirupsen/logrus"
 )
 
-type Config struct {
-	Push struct {
-		Dsn            string
-		FirebaseJson   string
-		IndividualPush bool
-	}
-}
-
 var GitCommit string
 var BuildDate string
-var DebugMode bool
+
+// Command line options overriding configuration, applied again on every reload.
+var logLevelOverride string
+var dbDriverOverride string
+var dbDsnOverride string
+var dryRunOverride bool
+var noSentryOverride bool
+var debugOverride bool
+
+const usage = `Usage: %s [flags] [command]
+
+Commands:
+  serve                      Run the service (default)
+  migrate up|down|status     Apply, roll back the last or list database migrations
+  fetch-once                 Fetch traffic events and cameras once into a scratch
+                             database (or the one passed with --db-dsn) and print them
+  send-test-push --token T   Send a test notification to a single device
+  tokens list|prune          List registered devices or remove ones unknown to FCM
+  version                    Print version information
+
+Flags must be passed before the command.
+
+Flags:
+`
 
 func main() {
-	DebugMode = false
+	os.Exit(run())
+}
+
+// run executes the command and returns the exit status, so deferred cleanup runs before the process exits.
+func run() int {
 	log.SetLevel(log.InfoLevel)
 
-	// Set logging to file when running in production
-	if len(os.Args) > 1 {
-		if os.Args[1] == "--production" {
-			os.Mkdir("log", 0755)
-			f, err := os.OpenFile("log/promet_push.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				sentry.CaptureException(err)
-				log.WithField("error", err).Error("Failed to open log file")
-			}
-			defer f.Close()
-			log.SetOutput(f)
-			log.SetFormatter(new(log.TextFormatter))
-		} else if os.Args[1] == "--debug" {
-			DebugMode = true
-			log.SetLevel(log.DebugLevel)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	configPath := flag.String("config", "promet_push.config", "Path to the configuration file")
+	flag.StringVar(&logLevelOverride, "log-level", "", "Log level, overrides log.level from configuration")
+	logFile := flag.String("log-file", "", "Append logs to this file instead of stderr")
+	flag.StringVar(&dbDriverOverride, "db-driver", "", "Database driver (postgres or sqlite3), overrides db.driver")
+	flag.StringVar(&dbDsnOverride, "db-dsn", "", "Database connection string, overrides db.dsn")
+	flag.BoolVar(&dryRunOverride, "dry-run", false, "Validate pushes with FCM without delivering them, same as push.dryRun")
+	flag.BoolVar(&noSentryOverride, "no-sentry", false, "Don't report errors to Sentry")
+	production := flag.Bool("production", false, "Deprecated, same as --log-file log/promet_push.log")
+	flag.BoolVar(&debugOverride, "debug", false, "Local development mode, same as --log-level debug --db-driver sqlite3 --db-dsn debug.db --dry-run --no-sentry "+
+		"with debug.logQueries and debug.resendKnownEvents enabled")
+	flag.Parse()
+
+	if *production && len(*logFile) == 0 {
+		os.Mkdir("log", 0755)
+		*logFile = "log/promet_push.log"
+	}
+
+	if debugOverride {
+		logLevelOverride = "debug"
+		dbDriverOverride = "sqlite3"
+		dbDsnOverride = "debug.db"
+		dryRunOverride = true
+		noSentryOverride = true
+	}
+
+	if len(*logFile) > 0 {
+		f, err := os.OpenFile(*logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.WithField("error", err).Error("Failed to open log file")
+			return 1
 		}
+		defer f.Close()
+		log.SetOutput(f)
+		log.SetFormatter(new(log.TextFormatter))
 	}
+
 	if len(GitCommit) == 0 {
 		GitCommit = "UNKNOWN"
 	}
@@ -54,77 +94,146 @@ func main() {
 		BuildDate = "UNKNOWN"
 	}
 
+	command := "serve"
+	args := flag.Args()
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	if command == "version" {
+		fmt.Printf("PrometPush version %s built on %s\n", GitCommit, BuildDate)
+		return 0
+	}
+
 	log.Infof("PrometPush version %s built on %s", GitCommit, BuildDate)
 
-	configuration := getConfiguration()
-	if !DebugMode {
-		// Since this is a daemon we want to use sync transport
-		// to Sentry server to make sure errors always reach it.
-		transport := sentry.NewHTTPSyncTransport()
-		transport.Timeout = time.Second * 3
+	err := runCommand(command, args, *configPath)
+	if errors.Is(err, errUsage) {
+		return 2
+	} else if err != nil {
+		log.WithField("err", err).Error("Command failed.")
+		return 1
+	}
+
+	return 0
+}
 
-		clientOptions := sentry.ClientOptions{
-			Dsn:       configuration.Push.Dsn,
-			Transport: transport,
+func runCommand(command string, args []string, configPath string) error {
+	switch command {
+	case "serve":
+		if err := noArgs(args); err != nil {
+			return err
 		}
 
-		if GitCommit != "UNKNOWN" {
-			clientOptions.Release = GitCommit
+		if err := getConfiguration(configPath, (*Config).ValidatePush); err != nil {
+			return err
 		}
 
-		err := sentry.Init(clientOptions)
-		if err != nil {
-			log.WithField("error", err).Error("Failed to initialize Sentry!")
+		return serve(configPath)
+	case "migrate":
+		if err := getConfiguration(configPath, (*Config).ValidateDb); err != nil {
+			return err
+		}
+
+		return migrate(args)
+	case "fetch-once":
+		if err := noArgs(args); err != nil {
+			return err
+		}
+
+		if err := getConfiguration(configPath, (*Config).Validate); err != nil {
+			return err
+		}
+
+		return fetchOnce()
+	case "send-test-push":
+		if err := getConfiguration(configPath, (*Config).ValidatePush); err != nil {
+			return err
+		}
+
+		return sendTestPush(args)
+	case "tokens":
+		// Only pruning talks to FCM.
+		validate := (*Config).ValidateDb
+		if len(args) > 0 && args[0] == "prune" {
+			validate = (*Config).ValidatePush
 		}
+
+		if err := getConfiguration(configPath, validate); err != nil {
+			return err
+		}
+
+		return tokens(args)
+	default:
+		flag.Usage()
+		return errUsage
 	}
+}
 
-	// Make sure Sentry captures panics.
-	defer sentry.Flush(time.Second * 5)
-	defer sentry.Recover()
+// noArgs fails when arguments follow a command which takes none, e.g. flags passed after the command
+// which would otherwise be silently ignored.
+func noArgs(args []string) error {
+	if len(args) > 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "Unexpected arguments %q.\n", args)
+		flag.Usage()
+		return errUsage
+	}
+
+	return nil
+}
 
-	if err := InitializeDbConnection(DebugMode); err != nil {
-		sentry.CaptureException(err)
-		panic("Failed to connect to database")
+// getConfiguration loads the configuration, checking it with the validation the command needs.
+func getConfiguration(path string, validate func(*Config) error) error {
+	cfg, err := LoadConfiguration(path)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
 	}
 
-	database := GetDbConnection()
-	defer database.Close()
+	applyOverrides(cfg)
+	if err := validate(cfg); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
 
-	eventIdsChannel := make(chan []string)
-	eventsChannel := make(chan []Dogodek)
-	camerasChannel := make(chan []Camera)
-	pricesChannel := make(chan []GasStationPrice)
+	log.WithField("config", cfg).Debug("Read configuration.")
+	SetConfiguration(cfg)
+	applyLogLevel(cfg)
+	return nil
+}
 
-	// Dispatcher processor
-	router := httprouter.New()
+// applyOverrides replaces configuration values with ones passed on the command line.
+func applyOverrides(cfg *Config) {
+	if len(logLevelOverride) > 0 {
+		cfg.Log.Level = logLevelOverride
+	}
 
-	go PushDispatcher(eventIdsChannel, configuration.Push.FirebaseJson, configuration.Push.IndividualPush, DebugMode)
-	go ApiService(eventsChannel, camerasChannel, pricesChannel, router)
+	if len(dbDriverOverride) > 0 {
+		cfg.Db.Driver = dbDriverOverride
+	}
 
-	ParseTrafficEvents(eventIdsChannel, eventsChannel, DebugMode)
-	ParseTrafficCameras(camerasChannel)
-	// Fuel prices are disabled because they're broken.
-	//ParseFuelPrices(pricesChannel)
-	c := cron.New()
-	c.AddFunc("@every 6m", func() { ParseTrafficEvents(eventIdsChannel, eventsChannel, DebugMode) })
-	//c.AddFunc("@every 6m", func() { ParseFuelPrices(pricesChannel) })
-	c.AddFunc("@every 30m", func() { ParseTrafficCameras(camerasChannel) })
-	c.Start()
+	if len(dbDsnOverride) > 0 {
+		cfg.Db.Dsn = dbDsnOverride
+	}
 
-	// Register HTTP functions
-	router.POST("/register", RegisterPush)
-	router.POST("/unregister", UnregisterPush)
-	router.GET("/stats", ShowStatistics)
-	log.Fatal(http.ListenAndServe(":8080", router))
+	if dryRunOverride {
+		cfg.Push.DryRun = true
+	}
+
+	if noSentryOverride {
+		cfg.Push.Dsn = ""
+	}
+
+	if debugOverride {
+		cfg.Debug.LogQueries = true
+		cfg.Debug.ResendKnownEvents = true
+	}
 }
 
-func getConfiguration() Config {
-	var cfg Config
-	err := gcfg.ReadFileInto(&cfg, "promet_push.config")
+func applyLogLevel(cfg *Config) {
+	level, err := log.ParseLevel(cfg.Log.Level)
 	if err != nil {
-		log.WithField("err", err).Error("Failed to parse configuration.")
+		log.WithField("err", err).Error("Invalid log level.")
+		return
 	}
 
-	log.WithField("config", cfg).Debug("Read configuration.")
-	return cfg
+	log.SetLevel(level)
 }
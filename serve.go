@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	. "github.com/izacus/PrometPush/src"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/julienschmidt/httprouter"
+	"github.com/robfig/cron"
+	log "github.com/sirupsen/logrus"
+)
+
+// Statistics kept in memory are saved this often, so little is lost on a crash.
+const statisticsSchedule = "@every 1m"
+
+// Delivery records older than push.receiptRetention are removed this often.
+const receiptsPruneSchedule = "@every 1h"
+
+// serve runs the service until it receives SIGINT or SIGTERM.
+func serve(configPath string) error {
+	configuration := GetConfiguration()
+	initSentry(configuration)
+
+	// Make sure Sentry captures panics.
+	defer sentry.Flush(time.Second * 5)
+	defer sentry.Recover()
+
+	if err := InitializeDbConnection(); err != nil {
+		sentry.CaptureException(err)
+		return fmt.Errorf("failed to connect to database: %v", err)
+	}
+
+	database := GetDbConnection()
+	defer database.Close()
+
+	if err := LoadStatistics(); err != nil {
+		log.WithField("err", err).Error("Failed to load today's statistics.")
+		sentry.CaptureException(err)
+	}
+
+	// Buffered so parsing isn't blocked while the dispatcher is sending out previous events.
+	eventIdsChannel := make(chan []string, 16)
+	eventsChannel := make(chan []Dogodek)
+	camerasChannel := make(chan []Camera)
+	pricesChannel := make(chan []GasStationPrice)
+	fuelChangesChannel := make(chan []FuelPriceChange, 4)
+
+	// Fetches are only cancelled when they don't finish in time on shutdown, the dispatcher is
+	// cancelled after they finished, so events they found are still sent out.
+	ctx, cancelFetches := context.WithCancel(context.Background())
+	defer cancelFetches()
+	dispatcherCtx, cancelDispatcher := context.WithCancel(context.Background())
+	defer cancelDispatcher()
+
+	// Dispatcher processor
+	router := httprouter.New()
+
+	client, err := NewMessagingClient(context.Background())
+	if err != nil {
+		sentry.CaptureException(err)
+		return fmt.Errorf("failed to initialize firebase client: %v", err)
+	}
+
+	dispatcherDone := make(chan struct{})
+	go func() {
+		PushDispatcher(dispatcherCtx, client, eventIdsChannel, fuelChangesChannel)
+		close(dispatcherDone)
+	}()
+	ApiService(eventsChannel, camerasChannel, pricesChannel, router)
+
+	// Reload configuration on SIGHUP, shut down on SIGINT and SIGTERM. Registered before the first fetches,
+	// so a signal received while they run is handled once they finish instead of killing the process.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	ParseTrafficEvents(ctx, eventIdsChannel, eventsChannel)
+	ParseTrafficCameras(ctx, camerasChannel)
+	if configuration.Schedule.FuelPricesEnabled {
+		ParseFuelPrices(ctx, pricesChannel, fuelChangesChannel)
+	}
+
+	var jobs jobTracker
+	job := jobs.track
+
+	startScheduler := func(cfg *Config) *cron.Cron {
+		c := cron.New()
+		c.AddFunc(cfg.Schedule.Events, job(func() { ParseTrafficEvents(ctx, eventIdsChannel, eventsChannel) }))
+		if cfg.Schedule.FuelPricesEnabled {
+			c.AddFunc(cfg.Schedule.FuelPrices, job(func() { ParseFuelPrices(ctx, pricesChannel, fuelChangesChannel) }))
+		}
+		c.AddFunc(cfg.Schedule.Cameras, job(func() { ParseTrafficCameras(ctx, camerasChannel) }))
+		if cfg.Archive.Enabled {
+			c.AddFunc(cfg.Archive.Schedule, job(func() { ArchiveCameraImages(ctx) }))
+		}
+		c.AddFunc(statisticsSchedule, job(SaveStatistics))
+		c.AddFunc(receiptsPruneSchedule, job(PruneNotifications))
+		c.Start()
+		return c
+	}
+
+	c := startScheduler(configuration)
+
+	// Register HTTP functions
+	router.POST("/register", RegisterPush)
+	router.POST("/unregister", UnregisterPush)
+	router.POST("/settings", UpdateDeviceSettings)
+	router.GET("/routes", ListRoutes)
+	router.POST("/routes", CreateRoute)
+	router.PUT("/routes/:id", UpdateRoute)
+	router.DELETE("/routes/:id", DeleteRoute)
+	router.GET("/fuel/stations/:id/prices", ShowFuelPriceHistory)
+	router.GET("/fuel/cheapest", ShowCheapestFuel)
+	router.GET("/cameras", ListCameras)
+	router.GET("/cameras/:location/:index/image", ShowCameraImage)
+	router.GET("/cameras/:location/:index/frames", ListCameraFrames)
+	router.GET("/events/:id/frames", ListEventFrames)
+	router.GET("/events/:id/deliveries", ShowEventDeliveries)
+	router.POST("/ack", AcknowledgeNotification)
+	router.GET("/frames/:id", ShowCameraFrame)
+	router.GET("/stats", ShowStatistics)
+	router.GET("/stats/history", ShowStatisticsHistory)
+
+	server := &http.Server{Addr: configuration.Server.Listen, Handler: router}
+	serverErrors := make(chan error, 1)
+	go func() {
+		serverErrors <- server.ListenAndServe()
+	}()
+
+	var serverErr error
+	for running := true; running; {
+		select {
+		case serverErr = <-serverErrors:
+			sentry.CaptureException(serverErr)
+			running = false
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				log.WithField("signal", sig).Info("Shutting down...")
+				running = false
+				continue
+			}
+
+			if newConfiguration := reloadConfiguration(configPath); newConfiguration != nil {
+				if newConfiguration.Schedule != configuration.Schedule || newConfiguration.Archive.Enabled != configuration.Archive.Enabled ||
+					newConfiguration.Archive.Schedule != configuration.Archive.Schedule {
+					log.WithFields(log.Fields{"schedule": newConfiguration.Schedule, "archive": newConfiguration.Archive.Enabled}).Info("Restarting scheduler.")
+					c.Stop()
+					c = startScheduler(newConfiguration)
+				}
+
+				configuration = newConfiguration
+			}
+		}
+	}
+
+	shutdown(cancelFetches, cancelDispatcher, c, server, &jobs, dispatcherDone)
+	if serverErr != nil {
+		return fmt.Errorf("HTTP server failed: %v", serverErr)
+	}
+
+	return nil
+}
+
+// jobTracker tracks running scheduled jobs, so shutdown can wait for them to finish.
+type jobTracker struct {
+	lock     sync.Mutex
+	stopping bool
+	running  sync.WaitGroup
+}
+
+// track wraps a scheduled job so it's counted while it runs. Jobs triggered after stop was called are skipped,
+// so the wait group isn't added to while it's waited on.
+func (t *jobTracker) track(run func()) func() {
+	return func() {
+		t.lock.Lock()
+		if t.stopping {
+			t.lock.Unlock()
+			return
+		}
+
+		t.running.Add(1)
+		t.lock.Unlock()
+		defer t.running.Done()
+		run()
+	}
+}
+
+// stop skips jobs triggered from now on and returns a channel closed once running jobs finish.
+func (t *jobTracker) stop() <-chan struct{} {
+	t.lock.Lock()
+	t.stopping = true
+	t.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.running.Wait()
+		close(done)
+	}()
+
+	return done
+}
+
+// shutdown stops accepting new work and waits for the work in progress to finish. Scheduled jobs
+// finish before the dispatcher is stopped, so it still sends out events they passed to it.
+func shutdown(cancelFetches context.CancelFunc, cancelDispatcher context.CancelFunc, c *cron.Cron, server *http.Server,
+	jobs *jobTracker, dispatcherDone <-chan struct{}) {
+	cfg := GetConfiguration()
+	c.Stop()
+
+	serverCtx, cancelServer := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout.Duration)
+	defer cancelServer()
+	if err := server.Shutdown(serverCtx); err != nil {
+		log.WithField("err", err).Warn("HTTP requests didn't finish in time.")
+	}
+
+	jobsDone := jobs.stop()
+	select {
+	case <-jobsDone:
+	case <-time.After(cfg.Server.ShutdownTimeout.Duration):
+		log.Warn("Scheduled jobs didn't finish in time, cancelling them.")
+		cancelFetches()
+		<-jobsDone
+	}
+
+	SaveStatistics()
+	cancelDispatcher()
+
+	// The dispatcher gives up on its own after the drain timeout, the extra time covers the last send.
+	select {
+	case <-dispatcherDone:
+	case <-time.After(cfg.Push.DrainTimeout.Duration + 10*time.Second):
+		log.Warn("Dispatcher didn't stop in time.")
+	}
+
+	log.Info("Shutdown complete.")
+}
+
+// reloadConfiguration re-reads the configuration file and applies settings which can change while running.
+// Returns nil when the new configuration is invalid and the old one is kept.
+func reloadConfiguration(path string) *Config {
+	log.WithField("path", path).Info("Reloading configuration.")
+	cfg, err := LoadConfiguration(path)
+	if err != nil {
+		log.WithField("err", err).Error("Invalid configuration, keeping the current one.")
+		sentry.CaptureException(err)
+		return nil
+	}
+
+	applyOverrides(cfg)
+	if err := cfg.ValidatePush(); err != nil {
+		log.WithField("err", err).Error("Invalid configuration, keeping the current one.")
+		return nil
+	}
+
+	old := GetConfiguration()
+	if restart := RestartRequired(old, cfg); len(restart) > 0 {
+		log.WithField("settings", restart).Warn("Changed settings will be applied after restart.")
+	}
+
+	SetConfiguration(cfg)
+	applyLogLevel(cfg)
+	if old.Push.Dsn != cfg.Push.Dsn {
+		sentry.Flush(time.Second * 5)
+		initSentry(cfg)
+	}
+
+	log.WithField("config", cfg).Debug("Configuration reloaded.")
+	return cfg
+}
+
+func initSentry(cfg *Config) {
+	if len(cfg.Push.Dsn) == 0 {
+		log.Info("Sentry DSN not set, errors won't be reported.")
+		// Disables a client initialized before the DSN was cleared on reload.
+		sentry.Init(sentry.ClientOptions{})
+		return
+	}
+
+	// Since this is a daemon we want to use sync transport
+	// to Sentry server to make sure errors always reach it.
+	transport := sentry.NewHTTPSyncTransport()
+	transport.Timeout = time.Second * 3
+
+	clientOptions := sentry.ClientOptions{
+		Dsn:       cfg.Push.Dsn,
+		Transport: transport,
+	}
+
+	if GitCommit != "UNKNOWN" {
+		clientOptions.Release = GitCommit
+	}
+
+	err := sentry.Init(clientOptions)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to initialize Sentry!")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/getsentry/sentry-go"
 	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
 )
@@ -28,6 +29,8 @@ type JsonEvent struct {
 	Updated          time.Time `json:"updated"`
 	ValidFrom        time.Time `json:"valid_from"`
 	ValidTo          time.Time `json:"valid_to"`
+	// Cameras close to the event, ones on the same road first.
+	Cameras []NearbyCamera `json:"cameras"`
 }
 
 // APIResponse represents data returned from the API to the client app.
@@ -35,16 +38,16 @@ type APIResponse struct {
 	Events  []JsonEvent       `json:"events"`
 	Cameras []Camera          `json:"cameras"`
 	Prices  []GasStationPrice `json:"prices"`
+	// Times the data was retrieved at, it's restored from the database after a restart until it's retrieved again.
+	Updated  DataAge `json:"updated"`
+	Restored bool    `json:"restored"`
 }
 
-var currentEvents []JsonEvent
-var currentCameras []Camera
-var currentPrices []GasStationPrice
-
 // ShowTrafficData renders current traffic data into JSON for the client app.
 func ShowTrafficData(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	r.Close = true
-	if currentEvents == nil || currentCameras == nil {
+	data := currentData()
+	if data.events == nil || data.cameras == nil {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
@@ -57,87 +60,125 @@ func ShowTrafficData(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 	var cameras []Camera
 	var prices []GasStationPrice
 
-	if currentEvents == nil {
+	if data.events == nil {
 		events = make([]JsonEvent, 0)
 	} else {
-		events = currentEvents
+		events = data.events
 	}
 
-	if currentCameras == nil {
+	if data.cameras == nil {
 		cameras = make([]Camera, 0)
 	} else {
-		cameras = currentCameras
+		cameras = data.cameras
 	}
 
-	if currentPrices == nil {
+	if data.prices == nil || !fuelPricesHealthy() {
 		prices = make([]GasStationPrice, 0)
 	} else {
-		prices = currentPrices
+		prices = data.prices
 	}
 
-	enc.Encode(APIResponse{events, cameras, prices})
+	restored := data.restoredEvents || data.restoredCameras || (data.restoredPrices && len(prices) > 0)
+	enc.Encode(APIResponse{events, cameras, prices, data.age, restored})
+}
+
+// toJsonEvents converts events to the format served to clients with the cameras nearby and maps their ids
+// to upstream ids.
+func toJsonEvents(events []Dogodek, cameras []Camera) ([]JsonEvent, map[int64]string) {
+	var jsonData = make([]JsonEvent, len(events))
+	eventIds := make(map[int64]string, len(events))
+
+	for i, event := range events {
+		// Calculate Id hash
+		algo := fnv.New32a()
+		algo.Write([]byte(event.Id))
+		idHash := int64(algo.Sum32())
+
+		jsonEvent := JsonEvent{
+			idHash,
+			event.Y_wgs,
+			event.X_wgs,
+			event.Kategorija,
+			event.Opis,
+			event.OpisEn,
+			event.Cesta,
+			event.CestaEn,
+			event.Vzrok,
+			event.VzrokEn,
+			event.Prioriteta,
+			event.PrioritetaCeste,
+			event.MejniPrehod,
+			event.UpdatedTime,
+			event.VeljavnostOdTime,
+			event.VeljavnostDoTime,
+			nearbyCameras(cameras, eventPosition(&event), event.Cesta),
+		}
+
+		jsonData[i] = jsonEvent
+		eventIds[idHash] = event.Id
+	}
+
+	return jsonData, eventIds
 }
 
 func eventService(eventsChannel <-chan []Dogodek) {
 	for {
 		events := <-eventsChannel
-		var jsonData = make([]JsonEvent, len(events))
-
-		for i, event := range events {
-			// Calculate Id hash
-			algo := fnv.New32a()
-			algo.Write([]byte(event.Id))
-			idHash := int64(algo.Sum32())
-
-			jsonEvent := JsonEvent{
-				idHash,
-				event.Y_wgs,
-				event.X_wgs,
-				event.Kategorija,
-				event.Opis,
-				event.OpisEn,
-				event.Cesta,
-				event.CestaEn,
-				event.Vzrok,
-				event.VzrokEn,
-				event.Prioriteta,
-				event.PrioritetaCeste,
-				event.MejniPrehod,
-				event.UpdatedTime,
-				event.VeljavnostOdTime,
-				event.VeljavnostDoTime,
-			}
-
-			jsonData[i] = jsonEvent
-		}
-
-		currentEvents = jsonData
-		log.WithFields(log.Fields{"data": currentEvents}).Debug("Updated event data.")
+		updateData(func(data *servedData) {
+			data.received = events
+			data.events, data.eventIds = toJsonEvents(events, data.cameras)
+			data.age.Events = time.Now().Unix()
+			data.restoredEvents = false
+		})
+
+		log.WithFields(log.Fields{"data": events}).Debug("Updated event data.")
 	}
 }
 
 func cameraService(camerasChannel <-chan []Camera) {
 	for {
 		cameras := <-camerasChannel
-		currentCameras = cameras
-		log.WithFields(log.Fields{"data": currentCameras}).Debug("Updated camera data.")
+		updateData(func(data *servedData) {
+			data.cameras = cameras
+			data.age.Cameras = time.Now().Unix()
+			data.restoredCameras = false
+			// Events may have been received before any cameras, e.g. on a cold start.
+			if data.received != nil {
+				data.events, data.eventIds = toJsonEvents(data.received, cameras)
+			}
+		})
+
+		log.WithFields(log.Fields{"data": cameras}).Debug("Updated camera data.")
 	}
 }
 
 func gasPricesService(pricesChannel <-chan []GasStationPrice) {
 	for {
 		prices := <-pricesChannel
-		currentPrices = prices
-		log.WithFields(log.Fields{"data": currentCameras}).Debug("Updated price data.")
+		updateData(func(data *servedData) {
+			data.prices = prices
+			data.age.Prices = time.Now().Unix()
+			data.restoredPrices = false
+		})
+
+		log.WithFields(log.Fields{"data": prices}).Debug("Updated price data.")
 	}
 }
 
+// ApiService registers the /data endpoint and restores stored data before returning, so it must be called before
+// the first fetch and before the server starts. Data received over the channels is then consumed in the background.
 func ApiService(eventsChannel <-chan []Dogodek,
 	camerasChannel <-chan []Camera,
 	pricesChannel <-chan []GasStationPrice,
 	router *httprouter.Router) {
 	router.GET("/data", ShowTrafficData)
 	log.Info("API hook registered.")
+
+	if err := restoreSnapshot(GetDbConnection()); err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Failed to restore stored data.")
+		sentry.CaptureException(err)
+	}
+
 	go eventService(eventsChannel)
 	go cameraService(camerasChannel)
 	go gasPricesService(pricesChannel)
@@ -0,0 +1,299 @@
+package src
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/jinzhu/gorm"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// CameraFrame is an archived camera image. Images are stored in archive.dir, named by their content.
+type CameraFrame struct {
+	Id           int64   `json:"id"`
+	LocationId   string  `json:"location_id" sql:"index"`
+	CameraIndex  int     `json:"index"`
+	Path         string  `json:"-"`
+	ContentType  string  `json:"-"`
+	Size         int64   `json:"-"`
+	Hash         string  `json:"-"`
+	CapturedTime int64   `json:"captured" sql:"index"`
+	X_wgs        float64 `json:"x_wgs"`
+	Y_wgs        float64 `json:"y_wgs"`
+
+	Url string `json:"url" sql:"-"`
+}
+
+func (f *CameraFrame) setUrl() {
+	f.Url = fmt.Sprintf("/frames/%d", f.Id)
+}
+
+// ArchiveCameraImages stores the current image of every camera, skipping images which didn't change
+// since the last frame, and removes frames exceeding retention limits.
+func ArchiveCameraImages(ctx context.Context) {
+	config := GetConfiguration().Archive
+	db := GetDbConnection()
+	now := time.Now()
+
+	archived := 0
+	cameras := currentData().cameras
+	for _, camera := range cameras {
+		if ctx.Err() != nil {
+			return
+		}
+
+		data, contentType, err := fetchCameraImage(ctx, camera.ImageURL)
+		if ctx.Err() == nil {
+			updateCameraStatus(camera, err)
+		}
+
+		if err != nil {
+			log.WithFields(log.Fields{"err": err, "url": camera.ImageURL}).Warn("Failed to archive camera image.")
+			continue
+		}
+
+		sum := sha1.Sum(data)
+		hash := hex.EncodeToString(sum[:])
+
+		var last CameraFrame
+		err = db.Where("location_id = ? AND camera_index = ?", camera.LocationId, camera.CameraIndex).Order("captured_time DESC").First(&last).Error
+		if err == nil && last.Hash == hash {
+			continue
+		}
+
+		path := filepath.Join(now.Format("2006-01-02"), hash)
+		if err := os.MkdirAll(filepath.Join(config.Dir, filepath.Dir(path)), 0755); err != nil {
+			sentry.CaptureException(err)
+			log.WithFields(log.Fields{"err": err}).Error("Failed to create archive directory.")
+			return
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(config.Dir, path), data, 0644); err != nil {
+			sentry.CaptureException(err)
+			log.WithFields(log.Fields{"err": err}).Error("Failed to store archived camera image.")
+			return
+		}
+
+		frame := CameraFrame{
+			LocationId:   camera.LocationId,
+			CameraIndex:  camera.CameraIndex,
+			Path:         path,
+			ContentType:  contentType,
+			Size:         int64(len(data)),
+			Hash:         hash,
+			CapturedTime: now.Unix(),
+			X_wgs:        camera.X_wgs,
+			Y_wgs:        camera.Y_wgs,
+		}
+
+		if err := db.Create(&frame).Error; err != nil {
+			sentry.CaptureException(err)
+			log.WithFields(log.Fields{"err": err}).Error("Failed to save camera frame.")
+			continue
+		}
+
+		archived++
+	}
+
+	log.WithFields(log.Fields{"archived": archived, "cameras": len(cameras)}).Info("Camera images archived.")
+	if err := pruneCameraFrames(db, now); err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"err": err}).Error("Failed to prune camera archive.")
+	}
+}
+
+// pruneCameraFrames removes frames older than archive.retention and the oldest frames above archive.maxSize.
+func pruneCameraFrames(db *gorm.DB, now time.Time) error {
+	config := GetConfiguration().Archive
+
+	var expired []CameraFrame
+	if err := db.Where("captured_time < ?", now.Add(-config.Retention.Duration).Unix()).Find(&expired).Error; err != nil {
+		return err
+	}
+
+	var total struct{ Size int64 }
+	if err := db.Model(&CameraFrame{}).Select("COALESCE(SUM(size), 0) AS size").Scan(&total).Error; err != nil {
+		return err
+	}
+
+	for _, frame := range expired {
+		total.Size -= frame.Size
+	}
+
+	// Frames are inserted in the order they're captured, so the oldest ones have the lowest ids.
+	var lastId int64
+	for total.Size > config.MaxSize {
+		var oldest []CameraFrame
+		if err := db.Where("id > ? AND captured_time >= ?", lastId, now.Add(-config.Retention.Duration).Unix()).Order("id").Limit(pageSize).Find(&oldest).Error; err != nil {
+			return err
+		}
+
+		if len(oldest) == 0 {
+			break
+		}
+
+		for _, frame := range oldest {
+			if total.Size <= config.MaxSize {
+				break
+			}
+
+			expired = append(expired, frame)
+			total.Size -= frame.Size
+			lastId = frame.Id
+		}
+	}
+
+	for _, frame := range expired {
+		if err := db.Delete(&frame).Error; err != nil {
+			return err
+		}
+
+		// Identical images share the file.
+		var references int
+		if err := db.Model(&CameraFrame{}).Where("path = ?", frame.Path).Count(&references).Error; err != nil {
+			return err
+		}
+
+		if references == 0 {
+			os.Remove(filepath.Join(config.Dir, frame.Path))
+		}
+	}
+
+	if len(expired) > 0 {
+		log.WithField("num", len(expired)).Info("Pruned camera archive.")
+	}
+
+	return nil
+}
+
+func parseTimeRange(r *http.Request) (int64, int64, error) {
+	from, to := int64(0), time.Now().Unix()
+	var err error
+	if value := r.URL.Query().Get("from"); len(value) > 0 {
+		if from, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid from, expected unix time")
+		}
+	}
+
+	if value := r.URL.Query().Get("to"); len(value) > 0 {
+		if to, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid to, expected unix time")
+		}
+	}
+
+	return from, to, nil
+}
+
+// ListCameraFrames lists archived frames of a camera captured between the from and to query parameters.
+func ListCameraFrames(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	index, err := strconv.Atoi(ps.ByName("index"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	frames := make([]CameraFrame, 0)
+	err = GetDbConnection().Where("location_id = ? AND camera_index = ? AND captured_time BETWEEN ? AND ?", ps.ByName("location"), index, from, to).
+		Order("captured_time").Find(&frames).Error
+	if err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"err": err}).Error("Failed to load camera frames.")
+		returnError(w)
+		return
+	}
+
+	for i := range frames {
+		frames[i].setUrl()
+	}
+
+	writeJSON(w, http.StatusOK, frames)
+}
+
+// ListEventFrames lists frames of cameras within archive.eventRadius of the event, captured within
+// archive.eventWindow of the time the event started or was last updated. Events can be passed by
+// the upstream id or by the id served in /data.
+func ListEventFrames(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	config := GetConfiguration().Archive
+	db := GetDbConnection()
+
+	event, err := findEvent(db, ps.ByName("id"))
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		sentry.CaptureException(err)
+		returnError(w)
+		return
+	}
+
+	start := int64(event.VeljavnostOd)
+	if start <= 0 {
+		start = int64(event.Updated)
+	}
+
+	window := int64(config.EventWindow.Duration / time.Second)
+	from, to := start-window, int64(event.Updated)+window
+	position := eventPosition(&event)
+	min, max := boundingBox(position, config.EventRadius)
+	var frames []CameraFrame
+	err = db.Where("captured_time BETWEEN ? AND ? AND y_wgs BETWEEN ? AND ? AND x_wgs BETWEEN ? AND ?", from, to, min.Lat, max.Lat, min.Lng, max.Lng).
+		Order("captured_time").Find(&frames).Error
+	if err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"err": err}).Error("Failed to load camera frames.")
+		returnError(w)
+		return
+	}
+
+	// Corners of the box are further than the radius.
+	nearby := make([]CameraFrame, 0)
+	for _, frame := range frames {
+		if distanceMeters(position, LatLng{frame.Y_wgs, frame.X_wgs}) <= config.EventRadius {
+			frame.setUrl()
+			nearby = append(nearby, frame)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, nearby)
+}
+
+// ShowCameraFrame serves an archived image, archived images never change.
+func ShowCameraFrame(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var frame CameraFrame
+	if err := GetDbConnection().Where("id = ?", ps.ByName("id")).First(&frame).Error; err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(filepath.Join(GetConfiguration().Archive.Dir, frame.Path))
+	if err != nil {
+		log.WithFields(log.Fields{"err": err, "frame": frame.Id}).Warn("Archived camera image is missing.")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", frame.ContentType)
+	w.Header().Set("ETag", `"`+frame.Hash+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, "", time.Unix(frame.CapturedTime, 0), file)
+}
@@ -0,0 +1,377 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+const thumbnailQuality = 80
+
+// Widths thumbnails can be requested in, so clients can't fill the cache with arbitrary sizes.
+var thumbnailWidths = []int{160, 320, 640, 1280}
+
+// imageCacheEntry is a cached camera image, its data is nil while it's spilled to disk.
+type imageCacheEntry struct {
+	data        []byte
+	size        int64
+	contentType string
+	etag        string
+	fetched     time.Time
+	lastUsed    time.Time
+	onDisk      bool
+}
+
+// imageCache keeps recently used images in memory and moves the least recently used ones to disk
+// when cameras.memoryCacheSize is exceeded.
+type imageCache struct {
+	lock       sync.Mutex
+	entries    map[string]*imageCacheEntry
+	memoryUsed int64
+	diskUsed   int64
+}
+
+var cameraImages = imageCache{entries: make(map[string]*imageCacheEntry)}
+
+// Coalesces concurrent upstream requests for the same image.
+var cameraImageFetches singleflight.Group
+
+func imageCacheFile(dir string, key string) string {
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(dir, hex.EncodeToString(sum[:]))
+}
+
+// get returns a copy of the cached entry with its data loaded, or nil.
+func (c *imageCache) get(key string) *imageCacheEntry {
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		c.lock.Unlock()
+		return nil
+	}
+
+	entry.lastUsed = time.Now()
+	result := *entry
+	c.lock.Unlock()
+
+	if result.onDisk {
+		data, err := ioutil.ReadFile(imageCacheFile(GetConfiguration().Cameras.DiskCacheDir, key))
+		if err != nil {
+			log.WithFields(log.Fields{"err": err, "key": key}).Warn("Failed to read cached camera image.")
+			c.remove(key)
+			return nil
+		}
+
+		result.data = data
+		c.put(key, data, result.contentType, result.fetched)
+	}
+
+	return &result
+}
+
+func (c *imageCache) put(key string, data []byte, contentType string, fetched time.Time) *imageCacheEntry {
+	sum := sha1.Sum(data)
+	entry := &imageCacheEntry{
+		data:        data,
+		size:        int64(len(data)),
+		contentType: contentType,
+		etag:        `"` + hex.EncodeToString(sum[:10]) + `"`,
+		fetched:     fetched,
+		lastUsed:    time.Now(),
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.removeLocked(key)
+	c.entries[key] = entry
+	c.memoryUsed += entry.size
+
+	// Eviction may spill the new entry too, callers still get its data.
+	result := *entry
+	c.evictLocked()
+	return &result
+}
+
+func (c *imageCache) remove(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *imageCache) removeLocked(key string) {
+	entry, ok := c.entries[key]
+	if !ok {
+		return
+	}
+
+	if entry.onDisk {
+		os.Remove(imageCacheFile(GetConfiguration().Cameras.DiskCacheDir, key))
+		c.diskUsed -= entry.size
+	} else {
+		c.memoryUsed -= entry.size
+	}
+
+	delete(c.entries, key)
+}
+
+// leastRecentlyUsed returns the key of the least recently used entry stored in memory or on disk.
+func (c *imageCache) leastRecentlyUsed(onDisk bool) string {
+	var oldestKey string
+	var oldest time.Time
+	for key, entry := range c.entries {
+		if entry.onDisk == onDisk && (len(oldestKey) == 0 || entry.lastUsed.Before(oldest)) {
+			oldestKey, oldest = key, entry.lastUsed
+		}
+	}
+
+	return oldestKey
+}
+
+func (c *imageCache) evictLocked() {
+	config := GetConfiguration().Cameras
+	for c.memoryUsed > config.MemoryCacheSize {
+		key := c.leastRecentlyUsed(false)
+		entry := c.entries[key]
+		if len(config.DiskCacheDir) == 0 {
+			c.removeLocked(key)
+			continue
+		}
+
+		if err := ioutil.WriteFile(imageCacheFile(config.DiskCacheDir, key), entry.data, 0644); err != nil {
+			log.WithFields(log.Fields{"err": err, "key": key}).Warn("Failed to spill camera image to disk.")
+			c.removeLocked(key)
+			continue
+		}
+
+		c.memoryUsed -= entry.size
+		c.diskUsed += entry.size
+		entry.data = nil
+		entry.onDisk = true
+	}
+
+	for c.diskUsed > config.DiskCacheSize {
+		c.removeLocked(c.leastRecentlyUsed(true))
+	}
+}
+
+// findCamera returns the index-th camera at the location.
+func findCamera(locationId string, index int) (Camera, bool) {
+	for _, camera := range currentData().cameras {
+		if camera.LocationId == locationId && camera.CameraIndex == index {
+			return camera, true
+		}
+	}
+
+	return Camera{}, false
+}
+
+// fetchCameraImage retrieves the image from upstream without retries, clients are waiting for it.
+func fetchCameraImage(ctx context.Context, url string) ([]byte, string, error) {
+	if !upstream.allow("camera-images") {
+		return nil, "", errCircuitOpen
+	}
+
+	response, err := upstream.fetchOnce(ctx, url)
+	if err == nil {
+		if contentType := http.DetectContentType(response.Body); strings.HasPrefix(contentType, "image/") {
+			upstream.record("camera-images", nil)
+			return response.Body, contentType, nil
+		}
+
+		err = fmt.Errorf("%w, got %s", errNotAnImage, http.DetectContentType(response.Body))
+	}
+
+	// A single camera missing its image doesn't mean the upstream is down.
+	var statusErr *upstreamStatusError
+	if errors.Is(err, errNotAnImage) || (errors.As(err, &statusErr) && statusErr.Code >= 400 && statusErr.Code < 500) {
+		upstream.record("camera-images", nil)
+	} else {
+		upstream.record("camera-images", err)
+	}
+
+	return nil, "", err
+}
+
+// refreshCameraImage fetches the image of the camera and caches it. Concurrent requests for the same
+// image share a single fetch, which keeps running when the client that started it goes away.
+func refreshCameraImage(ctx context.Context, camera Camera) (*imageCacheEntry, error) {
+	results := cameraImageFetches.DoChan(camera.ImageURL, func() (interface{}, error) {
+		data, contentType, err := fetchCameraImage(context.Background(), camera.ImageURL)
+		updateCameraStatus(camera, err)
+		if err != nil {
+			return nil, err
+		}
+
+		return cameraImages.put(camera.ImageURL, data, contentType, time.Now()), nil
+	})
+
+	select {
+	case result := <-results:
+		if result.Err != nil {
+			return nil, result.Err
+		}
+
+		return result.Val.(*imageCacheEntry), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resizeImage scales the image down to width by averaging source pixels.
+func resizeImage(src image.Image, width int) image.Image {
+	bounds := src.Bounds()
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+
+			offset := dst.PixOffset(x, y)
+			dst.Pix[offset] = uint8(r / n >> 8)
+			dst.Pix[offset+1] = uint8(g / n >> 8)
+			dst.Pix[offset+2] = uint8(b / n >> 8)
+			dst.Pix[offset+3] = uint8(a / n >> 8)
+		}
+	}
+
+	return dst
+}
+
+// thumbnail returns the image scaled to width, cached together with the original.
+func thumbnail(key string, original *imageCacheEntry, width int) (*imageCacheEntry, error) {
+	thumbnailKey := key + "#" + strconv.Itoa(width)
+	if cached := cameraImages.get(thumbnailKey); cached != nil && cached.fetched.Equal(original.fetched) {
+		return cached, nil
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(original.data))
+	if err != nil {
+		return nil, err
+	}
+
+	if width >= src.Bounds().Dx() {
+		return original, nil
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, resizeImage(src, width), &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return nil, err
+	}
+
+	return cameraImages.put(thumbnailKey, buf.Bytes(), "image/jpeg", original.fetched), nil
+}
+
+func validThumbnailWidth(width int) bool {
+	for _, allowed := range thumbnailWidths {
+		if width == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ShowCameraImage serves a cached copy of a camera image, optionally scaled down to the width query parameter.
+// When the upstream is unavailable, the last cached image is served and marked as stale.
+func ShowCameraImage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	index, err := strconv.Atoi(ps.ByName("index"))
+	if err != nil || index < 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	width := 0
+	if value := r.URL.Query().Get("width"); len(value) > 0 {
+		width, _ = strconv.Atoi(value)
+		if !validThumbnailWidth(width) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Width must be one of %v.", thumbnailWidths)))
+			return
+		}
+	}
+
+	camera, ok := findCamera(ps.ByName("location"), index)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	maxAge := GetConfiguration().Cameras.ImageMaxAge.Duration
+	key := camera.ImageURL
+	entry := cameraImages.get(key)
+	stale := false
+	if entry == nil || time.Since(entry.fetched) >= maxAge {
+		fetched, err := refreshCameraImage(r.Context(), camera)
+		switch {
+		case r.Context().Err() != nil:
+			return
+		case err == nil:
+			entry = fetched
+		case entry == nil:
+			log.WithFields(log.Fields{"err": err, "url": key}).Warn("Failed to retrieve camera image.")
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		default:
+			log.WithFields(log.Fields{"err": err, "url": key}).Warn("Failed to refresh camera image, serving stale copy.")
+			stale = true
+		}
+	}
+
+	if width > 0 {
+		if entry, err = thumbnail(key, entry, width); err != nil {
+			sentry.CaptureException(err)
+			log.WithFields(log.Fields{"err": err, "url": key}).Error("Failed to create camera thumbnail.")
+			returnError(w)
+			return
+		}
+	}
+
+	remaining := maxAge - time.Since(entry.fetched)
+	if stale || remaining < 0 {
+		remaining = 0
+	}
+
+	w.Header().Set("Content-Type", entry.contentType)
+	w.Header().Set("ETag", entry.etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(remaining/time.Second)))
+	if stale {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+		w.Header().Set("X-Image-Stale", "true")
+	}
+
+	http.ServeContent(w, r, "", entry.fetched, bytes.NewReader(entry.data))
+}
@@ -0,0 +1,91 @@
+package src
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func setImageCacheTestConfig(diskCacheDir string) {
+	cfg := DefaultConfig()
+	cfg.Cameras.MemoryCacheSize = 20
+	cfg.Cameras.DiskCacheDir = diskCacheDir
+	cfg.Cameras.DiskCacheSize = 20
+	SetConfiguration(cfg)
+}
+
+// putAged stores an image last used the passed duration ago, so eviction order doesn't depend on clock resolution.
+func putAged(c *imageCache, key string, size int, age time.Duration) {
+	c.put(key, bytes.Repeat([]byte(key), size), "image/jpeg", time.Now())
+	c.entries[key].lastUsed = time.Now().Add(-age)
+}
+
+func TestImageCacheMemoryEviction(t *testing.T) {
+	setImageCacheTestConfig("")
+	c := imageCache{entries: make(map[string]*imageCacheEntry)}
+	putAged(&c, "a", 10, 3*time.Minute)
+	putAged(&c, "b", 10, 2*time.Minute)
+	c.get("a")
+	putAged(&c, "c", 10, time.Minute)
+
+	if c.get("b") != nil {
+		t.Error("least recently used image wasn't evicted")
+	}
+
+	if c.get("a") == nil || c.get("c") == nil {
+		t.Error("recently used images were evicted")
+	}
+
+	if c.memoryUsed != 20 || c.diskUsed != 0 {
+		t.Errorf("unexpected usage %d in memory and %d on disk", c.memoryUsed, c.diskUsed)
+	}
+}
+
+func TestImageCacheDiskSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "promet_push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	setImageCacheTestConfig(dir)
+	c := imageCache{entries: make(map[string]*imageCacheEntry)}
+	putAged(&c, "a", 10, 4*time.Minute)
+	putAged(&c, "b", 10, 3*time.Minute)
+	putAged(&c, "c", 10, 2*time.Minute)
+
+	if entry := c.entries["a"]; !entry.onDisk || entry.data != nil {
+		t.Fatalf("least recently used image wasn't spilled to disk, got %+v", entry)
+	}
+
+	if c.memoryUsed != 20 || c.diskUsed != 10 {
+		t.Errorf("unexpected usage %d in memory and %d on disk", c.memoryUsed, c.diskUsed)
+	}
+
+	// Reading a spilled image moves it back to memory and spills the next least recently used one.
+	entry := c.get("a")
+	if entry == nil || !bytes.Equal(entry.data, bytes.Repeat([]byte("a"), 10)) {
+		t.Fatalf("spilled image wasn't read back, got %+v", entry)
+	}
+
+	if c.entries["a"].onDisk || !c.entries["b"].onDisk {
+		t.Errorf("unexpected placement, a on disk %v, b on disk %v", c.entries["a"].onDisk, c.entries["b"].onDisk)
+	}
+
+	// The disk cache drops images once it's full.
+	putAged(&c, "d", 10, time.Minute)
+	putAged(&c, "e", 10, 0)
+	if _, ok := c.entries["b"]; ok {
+		t.Error("least recently used image wasn't dropped from disk")
+	}
+
+	if _, err := os.Stat(imageCacheFile(dir, "b")); !os.IsNotExist(err) {
+		t.Errorf("dropped image file wasn't removed: %v", err)
+	}
+
+	if c.memoryUsed != 20 || c.diskUsed != 20 || len(c.entries) != 4 {
+		t.Errorf("unexpected usage %d in memory and %d on disk with %d images", c.memoryUsed, c.diskUsed, len(c.entries))
+	}
+}
@@ -1,21 +1,50 @@
 package src
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/getsentry/sentry-go"
+	"github.com/jinzhu/gorm"
+	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
 )
 
+// Camera is a camera at a location, index is its position within the location. Cameras are stored,
+// so the last known ones are served after a restart and changes between fetches can be tracked.
 type Camera struct {
-	LocationId string  `json:"location_id"`
-	Region     string  `json:"region"`
-	Text       string  `json:"text"`
-	ImageURL   string  `json:"image_url"`
-	X_wgs      float64 `json:"x_wgs"`
-	Y_wgs      float64 `json:"y_wgs"`
+	Id          string  `json:"id"`
+	LocationId  string  `json:"location_id" sql:"index"`
+	CameraIndex int     `json:"index"`
+	Region      string  `json:"region"`
+	Text        string  `json:"text"`
+	ImageURL    string  `json:"image_url"`
+	X_wgs       float64 `json:"x_wgs"`
+	Y_wgs       float64 `json:"y_wgs"`
+	// Set when upstream failed to return the camera image the last time it was requested.
+	Offline bool `json:"offline"`
+	// Set when the camera disappeared from upstream.
+	Removed       bool  `json:"removed"`
+	FirstSeenTime int64 `json:"first_seen"`
+	UpdatedTime   int64 `json:"updated"`
+}
+
+// CameraChanges lists ids of cameras which changed with a fetch.
+type CameraChanges struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+func cameraId(locationId string, index int) string {
+	return locationId + "/" + strconv.Itoa(index)
 }
 
 type JsonCamera struct {
@@ -33,22 +62,21 @@ type JsonLocation struct {
 	Cameras     []JsonCamera `json:"Kamere"`
 }
 
-func ParseTrafficCameras(camerasChannel chan<- []Camera) error {
+func ParseTrafficCameras(ctx context.Context, camerasChannel chan<- []Camera) error {
 	log.Debug("Retrieving camera data...")
-	url := "https://opendata.si/promet/cameras/"
-	response, err := http.Get(url)
+	url := GetConfiguration().Upstream.CamerasUrl
+	response, err := upstream.fetch(ctx, "cameras", url)
 	if err != nil {
-		if response != nil {
-			log.WithFields(log.Fields{"status": response.Status, "err": err}).Error("Failed to retrieve data from server.")
-		} else {
-			log.WithFields(log.Fields{"err": err}).Error("Failed to retrieve data from server.")
-		}
-
-		sentry.CaptureException(err)
 		return err
 	}
 
-	dec := json.NewDecoder(response.Body)
+	if response.NotModified {
+		log.Debug("Cameras not modified.")
+		recordFetch(GetDbConnection(), "cameras", time.Now())
+		updateData(func(data *servedData) { data.age.Cameras = time.Now().Unix() })
+		return nil
+	}
+
 	var data struct {
 		Contents []struct {
 			Data struct {
@@ -57,25 +85,8 @@ func ParseTrafficCameras(camerasChannel chan<- []Camera) error {
 		} `json:"Contents"`
 	}
 
-	decodeErr := dec.Decode(&data)
-	if decodeErr != nil {
-		buf := new(bytes.Buffer)
-		buf.ReadFrom(response.Body)
-
-		sentry.AddBreadcrumb(&sentry.Breadcrumb{
-			Category: "upstream-api",
-			Message:  buf.String(),
-			Level:    "error",
-		})
-
-		sentry.CaptureException(decodeErr)
-		if decodeErr != nil {
-			sentry.CaptureException(decodeErr)
-		} else {
-			sentry.CaptureMessage("Invalid upstream server response!")
-		}
-
-		log.Error("Invalid response from server!")
+	if err := json.Unmarshal(response.Body, &data); err != nil {
+		reportInvalidResponse(response, err)
 		return err
 	}
 
@@ -87,15 +98,25 @@ func ParseTrafficCameras(camerasChannel chan<- []Camera) error {
 	items := data.Contents[0].Data.C
 
 	var cameras = make([]Camera, 0)
+	var quarantined []QuarantinedItem
+	total := 0
 	for _, item := range items {
-		for _, jsonCamera := range item.Cameras {
+		for index, jsonCamera := range item.Cameras {
 			camera := Camera{
-				item.Id,
-				jsonCamera.Region,
-				jsonCamera.Text,
-				jsonCamera.Image,
-				item.X_wgs,
-				item.Y_wgs,
+				Id:          cameraId(item.Id, index),
+				LocationId:  item.Id,
+				CameraIndex: index,
+				Region:      jsonCamera.Region,
+				Text:        jsonCamera.Text,
+				ImageURL:    jsonCamera.Image,
+				X_wgs:       item.X_wgs,
+				Y_wgs:       item.Y_wgs,
+			}
+
+			total++
+			if reason := validateCamera(camera); len(reason) > 0 {
+				quarantined = append(quarantined, newQuarantinedItem("cameras", camera.LocationId, reason, camera))
+				continue
 			}
 
 			cameras = append(cameras, camera)
@@ -103,6 +124,257 @@ func ParseTrafficCameras(camerasChannel chan<- []Camera) error {
 	}
 
 	log.WithFields(log.Fields{"status": response.Status, "num": len(items)}).Debug("Camera retrieval ok.")
-	camerasChannel <- cameras
+	if err := quarantine(GetDbConnection(), "cameras", quarantined); err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Failed to store quarantined cameras!")
+		sentry.CaptureException(err)
+	}
+
+	if err := guard.check("cameras", total, len(cameras), GetConfiguration().Guard.MinCameras); err != nil {
+		return err
+	}
+
+	var changes CameraChanges
+	now := time.Now()
+	err = GetDbConnection().Transaction(func(tx *gorm.DB) error {
+		var err error
+		if changes, err = storeCameras(tx, cameras, now); err != nil {
+			return err
+		}
+
+		recordFetch(tx, "cameras", now)
+		return nil
+	})
+
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Failed to store cameras!")
+		sentry.CaptureException(err)
+		return err
+	}
+
+	UpdateStatistics(func(s *Statistics) {
+		s.AddedCameras += len(changes.Added)
+		s.RemovedCameras += len(changes.Removed)
+		s.ChangedCameras += len(changes.Changed)
+	})
+
+	if len(changes.Added) > 0 || len(changes.Removed) > 0 || len(changes.Changed) > 0 {
+		log.WithFields(log.Fields{"added": changes.Added, "removed": changes.Removed, "changed": changes.Changed}).Info("Cameras changed.")
+	}
+
+	upstream.remember(response)
+	select {
+	case camerasChannel <- cameras:
+	case <-ctx.Done():
+	}
+
 	return nil
 }
+
+// storeCameras saves fetched cameras, marks cameras missing from the fetch as removed and returns what changed.
+// Fetched cameras get their stored state filled in.
+func storeCameras(tx *gorm.DB, cameras []Camera, now time.Time) (CameraChanges, error) {
+	var changes CameraChanges
+	var stored []Camera
+	if err := tx.Find(&stored).Error; err != nil {
+		return changes, err
+	}
+
+	storedById := make(map[string]Camera, len(stored))
+	for _, camera := range stored {
+		storedById[camera.Id] = camera
+	}
+
+	fetched := make(map[string]bool, len(cameras))
+	for i := range cameras {
+		camera := &cameras[i]
+		fetched[camera.Id] = true
+
+		old, ok := storedById[camera.Id]
+		camera.FirstSeenTime, camera.UpdatedTime = now.Unix(), now.Unix()
+		switch {
+		case !ok || old.Removed:
+			changes.Added = append(changes.Added, camera.Id)
+		case old.Region != camera.Region || old.Text != camera.Text || old.ImageURL != camera.ImageURL ||
+			old.X_wgs != camera.X_wgs || old.Y_wgs != camera.Y_wgs:
+			changes.Changed = append(changes.Changed, camera.Id)
+			camera.FirstSeenTime, camera.Offline = old.FirstSeenTime, old.Offline
+		default:
+			camera.FirstSeenTime, camera.UpdatedTime, camera.Offline = old.FirstSeenTime, old.UpdatedTime, old.Offline
+			continue
+		}
+
+		if err := tx.Save(camera).Error; err != nil {
+			return changes, err
+		}
+	}
+
+	for _, camera := range stored {
+		if camera.Removed || fetched[camera.Id] {
+			continue
+		}
+
+		changes.Removed = append(changes.Removed, camera.Id)
+		if err := tx.Model(&camera).Updates(map[string]interface{}{"removed": true, "updated_time": now.Unix()}).Error; err != nil {
+			return changes, err
+		}
+	}
+
+	return changes, nil
+}
+
+// loadCameras returns the last known cameras, in the order upstream lists them within locations.
+func loadCameras(db *gorm.DB) ([]Camera, error) {
+	var cameras []Camera
+	err := db.Where("removed = ?", false).Order("location_id, camera_index").Find(&cameras).Error
+	return cameras, err
+}
+
+var errNotAnImage = errors.New("upstream returned no image")
+
+// cameraStatusLock serializes changes of camera online status.
+var cameraStatusLock sync.Mutex
+
+// updateCameraStatus marks the camera offline when upstream responded to an image request with an error or
+// something else than an image, and back online once an image is retrieved.
+func updateCameraStatus(camera Camera, err error) {
+	var statusErr *upstreamStatusError
+	offline := errors.As(err, &statusErr) || errors.Is(err, errNotAnImage)
+	if err != nil && !offline {
+		// Upstream couldn't be reached, which says nothing about the camera.
+		return
+	}
+
+	cameraStatusLock.Lock()
+	defer cameraStatusLock.Unlock()
+
+	cameras := currentData().cameras
+	position := -1
+	for i := range cameras {
+		if cameras[i].Id == camera.Id {
+			position = i
+			break
+		}
+	}
+
+	if position < 0 || cameras[position].Offline == offline {
+		return
+	}
+
+	now := time.Now().Unix()
+	update := map[string]interface{}{"offline": offline, "updated_time": now}
+	if err := GetDbConnection().Model(&Camera{}).Where("id = ?", camera.Id).Updates(update).Error; err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"err": err, "camera": camera.Id}).Error("Failed to update camera status.")
+		return
+	}
+
+	if offline {
+		UpdateStatistics(func(s *Statistics) { s.CameraOutages++ })
+		log.WithFields(log.Fields{"err": err, "camera": camera.Id}).Warn("Camera went offline.")
+	} else {
+		log.WithField("camera", camera.Id).Info("Camera is back online.")
+	}
+
+	// Cameras may have been replaced by a fetch in the meantime, so the camera is looked up again.
+	updateData(func(data *servedData) {
+		updated := make([]Camera, len(data.cameras))
+		copy(updated, data.cameras)
+		for i := range updated {
+			if updated[i].Id == camera.Id {
+				updated[i].Offline = offline
+				updated[i].UpdatedTime = now
+			}
+		}
+
+		data.cameras = updated
+	})
+}
+
+// ListCameras lists all known cameras including removed ones, optionally only ones changed since the since
+// query parameter.
+func ListCameras(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := GetDbConnection()
+	if since := r.URL.Query().Get("since"); len(since) > 0 {
+		value, err := strconv.ParseInt(since, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid since, expected unix time."))
+			return
+		}
+
+		query = query.Where("updated_time >= ?", value)
+	}
+
+	cameras := make([]Camera, 0)
+	if err := query.Order("location_id, camera_index").Find(&cameras).Error; err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"err": err}).Error("Failed to load cameras.")
+		returnError(w)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, cameras)
+}
+
+// NearbyCamera references a camera close to an event, index is the position of the camera within its location.
+type NearbyCamera struct {
+	LocationId string `json:"location_id"`
+	Index      int    `json:"index"`
+	Text       string `json:"text,omitempty"`
+	Distance   int    `json:"distance"`
+}
+
+// Matches Slovenian road designations like A1, H4 or G2-103.
+var roadDesignation = regexp.MustCompile(`\b[AHGR][0-9]+(-[0-9]+)?\b`)
+
+func onRoad(camera Camera, roads []string) bool {
+	for _, designation := range roadDesignation.FindAllString(camera.Text+" "+camera.Region, -1) {
+		for _, road := range roads {
+			if designation == road {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// nearbyCameras returns up to cameras.nearbyLimit cameras within cameras.nearbyRadius of the position,
+// cameras on the same road first, then the closest ones.
+func nearbyCameras(cameras []Camera, position LatLng, road string) []NearbyCamera {
+	config := GetConfiguration().Cameras
+	roads := roadDesignation.FindAllString(road, -1)
+
+	type candidate struct {
+		camera   NearbyCamera
+		sameRoad bool
+	}
+
+	var candidates []candidate
+	for _, camera := range cameras {
+		distance := distanceMeters(position, LatLng{camera.Y_wgs, camera.X_wgs})
+		if distance > config.NearbyRadius {
+			continue
+		}
+
+		candidates = append(candidates, candidate{
+			NearbyCamera{camera.LocationId, camera.CameraIndex, camera.Text, int(distance)},
+			onRoad(camera, roads),
+		})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].sameRoad != candidates[j].sameRoad {
+			return candidates[i].sameRoad
+		}
+
+		return candidates[i].camera.Distance < candidates[j].camera.Distance
+	})
+
+	nearby := make([]NearbyCamera, 0, config.NearbyLimit)
+	for i := 0; i < len(candidates) && i < config.NearbyLimit; i++ {
+		nearby = append(nearby, candidates[i].camera)
+	}
+
+	return nearby
+}
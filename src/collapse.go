@@ -0,0 +1,96 @@
+package src
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"time"
+
+	"firebase.google.com/go/messaging"
+)
+
+// collapseKey returns a key identifying the set of pushed events. Pushes for a single event
+// use the stable event id, so an update or clearance of the event replaces the earlier notification
+// on the device. Only digests carry multiple events.
+func collapseKey(events []PushEvent) string {
+	if len(events) == 1 {
+		return fmt.Sprintf("event-%d", events[0].Id)
+	}
+
+	ids := make([]int64, len(events))
+	for i, event := range events {
+		ids[i] = event.Id
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	algo := fnv.New32a()
+	for _, id := range ids {
+		algo.Write([]byte(strconv.FormatInt(id, 10)))
+		algo.Write([]byte{','})
+	}
+
+	return fmt.Sprintf("events-%d", algo.Sum32())
+}
+
+// pushTTL returns how long FCM should keep the push for offline devices. It's based on validity
+// of the longest valid event in the payload.
+func pushTTL(events []PushEvent, now time.Time) time.Duration {
+	var validUntil uint64
+	for _, event := range events {
+		if event.Valid > validUntil {
+			validUntil = event.Valid
+		}
+	}
+
+	// Long running events (e.g. road works) are valid for months, but there's no point in delivering
+	// a push about them to a device which was offline for longer than the maximum TTL.
+	config := GetConfiguration().Push
+	if validUntil == 0 {
+		return config.DefaultTtl.Duration
+	}
+
+	ttl := time.Unix(0, int64(validUntil)*int64(time.Millisecond)).Sub(now)
+	if ttl < config.MinTtl.Duration {
+		return config.MinTtl.Duration
+	}
+
+	if ttl > config.MaxTtl.Duration {
+		return config.MaxTtl.Duration
+	}
+
+	return ttl.Truncate(time.Second)
+}
+
+// platformConfigs builds per platform options making devices replace notifications for the same events.
+// Data messages don't show notifications by themselves, so the tag is also passed to the app in data.
+func platformConfigs(events []PushEvent, data map[string]string, now time.Time) (*messaging.AndroidConfig, *messaging.APNSConfig, *messaging.WebpushConfig) {
+	key := collapseKey(events)
+	data["tag"] = key
+	return collapsingConfigs(key, pushTTL(events, now), now)
+}
+
+// collapsingConfigs builds per platform options replacing earlier notifications with the same key and expiring
+// the push after ttl.
+func collapsingConfigs(key string, ttl time.Duration, now time.Time) (*messaging.AndroidConfig, *messaging.APNSConfig, *messaging.WebpushConfig) {
+	android := &messaging.AndroidConfig{
+		CollapseKey: key,
+		TTL:         &ttl,
+	}
+
+	apns := &messaging.APNSConfig{
+		Headers: map[string]string{
+			"apns-collapse-id": key,
+			"apns-expiration":  strconv.FormatInt(now.Add(ttl).Unix(), 10),
+		},
+	}
+
+	webpush := &messaging.WebpushConfig{
+		Headers: map[string]string{
+			"Topic": key,
+			"TTL":   strconv.FormatInt(int64(ttl/time.Second), 10),
+		},
+	}
+
+	return android, apns, webpush
+}
@@ -0,0 +1,529 @@
+package src
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron"
+	"github.com/scalingdata/gcfg"
+	log "github.com/sirupsen/logrus"
+)
+
+// Prefix of environment variables overriding configuration values. Variables are named
+// after section and variable, e.g. PROMET_PUSH_DB_DSN or PROMET_PUSH_PUSH_INDIVIDUALPUSH.
+const configEnvPrefix = "PROMET_PUSH_"
+
+// Duration is a time.Duration which can be read from the configuration file as e.g. "2h" or "30s".
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText parses the duration from the configuration file.
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+
+	d.Duration = duration
+	return nil
+}
+
+type DbConfig struct {
+	Driver string
+	Dsn    string
+	// Dbname is kept for old configuration files, it's used to build the DSN when it's not set.
+	Dbname       string
+	MaxIdleConns int
+}
+
+type ServerConfig struct {
+	Listen string
+	// How long to wait for HTTP requests in progress when shutting down.
+	ShutdownTimeout Duration
+}
+
+type LogConfig struct {
+	// One of logrus levels, e.g. debug, info or warning.
+	Level string
+}
+
+type ScheduleConfig struct {
+	Events            string
+	Cameras           string
+	FuelPrices        string
+	FuelPricesEnabled bool
+}
+
+type UpstreamConfig struct {
+	EventsUrl     string
+	CamerasUrl    string
+	FuelPricesUrl string
+	// Time limit for a single request to an upstream server.
+	Timeout     Duration
+	RetryCount  int
+	RetryDelay  Duration
+	MaxBodySize int64
+	// Requests to an upstream are paused for breakerCooldown after breakerThreshold failed fetches in a row.
+	BreakerThreshold int
+	BreakerCooldown  Duration
+}
+
+type PushConfig struct {
+	// Sentry DSN
+	Dsn            string
+	FirebaseJson   string
+	IndividualPush bool
+
+	DefaultTtl     Duration
+	MinTtl         Duration
+	MaxTtl         Duration
+	RetryCount     int
+	RetryDelay     Duration
+	Concurrency    int
+	DigestInterval Duration
+	// Validate pushes with FCM without delivering them.
+	DryRun bool
+	// How long to keep sending queued events when shutting down.
+	DrainTimeout Duration
+	// How long to keep delivery records of sent notifications.
+	ReceiptRetention Duration
+	// Every event is sent in its own message, so at most this many are sent per fetch and the rest are skipped.
+	MaxEventsPerCycle int
+}
+
+// CamerasConfig holds settings of the camera image proxy and of cameras attached to events.
+type CamerasConfig struct {
+	// Cached images are refreshed from upstream when they're older than this.
+	ImageMaxAge     Duration
+	MemoryCacheSize int64
+	// Images not fitting in memory are moved to this directory, they're dropped when it's empty.
+	DiskCacheDir  string
+	DiskCacheSize int64
+	// Up to nearbyLimit cameras within nearbyRadius meters are attached to each event.
+	NearbyRadius float64
+	NearbyLimit  int
+	// Include nearby cameras in push payloads.
+	NearbyInPush bool
+}
+
+// ArchiveConfig holds settings of the camera image archive.
+type ArchiveConfig struct {
+	Enabled  bool
+	Schedule string
+	Dir      string
+	// Frames are removed when they're older than retention or the archive grows over maxSize bytes.
+	Retention Duration
+	MaxSize   int64
+	// Frames of cameras within eventRadius meters are linked to an event, when they were captured
+	// at most eventWindow before the event started or after it was last updated.
+	EventRadius float64
+	EventWindow Duration
+}
+
+// FuelConfig selects where fuel prices come from.
+type FuelConfig struct {
+	// bencinmonitor or file
+	Provider string
+	// JSON file with prices in /data format, used by the file provider.
+	File string
+	// Prices aren't served when the last successful fetch is older than this.
+	MaxAge Duration
+	// Push regulated price changes to subscribed devices.
+	Alerts bool
+}
+
+// GuardConfig holds thresholds for rejecting fetches which look broken.
+type GuardConfig struct {
+	MinEvents  int
+	MinCameras int
+	// Largest fraction of items which may disappear between two fetches.
+	MaxDrop float64
+	// Largest fraction of items which may fail validation.
+	MaxInvalid float64
+	// Number of anomalous fetches in a row after which the change is accepted anyway.
+	MaxRejections int
+}
+
+// DebugConfig holds settings useful when developing locally.
+type DebugConfig struct {
+	// Log all database queries.
+	LogQueries bool
+	// Treat all events as new on every fetch, so they're pushed again.
+	ResendKnownEvents bool
+}
+
+// Config holds all settings of the service read from promet_push.config.
+type Config struct {
+	Db       DbConfig
+	Server   ServerConfig
+	Log      LogConfig
+	Schedule ScheduleConfig
+	Upstream UpstreamConfig
+	Push     PushConfig
+	Cameras  CamerasConfig
+	Archive  ArchiveConfig
+	Fuel     FuelConfig
+	Guard    GuardConfig
+	Debug    DebugConfig
+
+	// Topic sections configure FCM topics and the events they receive.
+	Topic map[string]*EventFilter
+}
+
+// DefaultConfig returns the configuration used for values missing in the configuration file.
+func DefaultConfig() *Config {
+	cfg := &Config{}
+	cfg.Db.Driver = "postgres"
+	cfg.Db.MaxIdleConns = 10
+	cfg.Server.Listen = ":8080"
+	cfg.Server.ShutdownTimeout = Duration{10 * time.Second}
+	cfg.Log.Level = "info"
+	cfg.Schedule.Events = "@every 6m"
+	cfg.Schedule.Cameras = "@every 30m"
+	cfg.Schedule.FuelPrices = "@every 6m"
+	cfg.Schedule.FuelPricesEnabled = true
+	cfg.Upstream.EventsUrl = "https://opendata.si/promet/events/"
+	cfg.Upstream.CamerasUrl = "https://opendata.si/promet/cameras/"
+	cfg.Upstream.FuelPricesUrl = "https://api.bencinmonitor.si/stations?forMobile=true"
+	cfg.Upstream.Timeout = Duration{30 * time.Second}
+	cfg.Upstream.RetryCount = 2
+	cfg.Upstream.RetryDelay = Duration{2 * time.Second}
+	cfg.Upstream.MaxBodySize = 20 << 20
+	cfg.Upstream.BreakerThreshold = 5
+	cfg.Upstream.BreakerCooldown = Duration{15 * time.Minute}
+	cfg.Push.DefaultTtl = Duration{2 * time.Hour}
+	cfg.Push.MinTtl = Duration{5 * time.Minute}
+	cfg.Push.MaxTtl = Duration{24 * time.Hour}
+	cfg.Push.RetryCount = 5
+	cfg.Push.RetryDelay = Duration{10 * time.Second}
+	cfg.Push.Concurrency = 4
+	cfg.Push.DigestInterval = Duration{time.Minute}
+	cfg.Push.DrainTimeout = Duration{30 * time.Second}
+	cfg.Push.ReceiptRetention = Duration{30 * 24 * time.Hour}
+	cfg.Push.MaxEventsPerCycle = 10
+	cfg.Cameras.ImageMaxAge = Duration{time.Minute}
+	cfg.Cameras.MemoryCacheSize = 64 << 20
+	cfg.Cameras.DiskCacheSize = 512 << 20
+	cfg.Cameras.NearbyRadius = 5000
+	cfg.Cameras.NearbyLimit = 3
+	cfg.Archive.Schedule = "@every 10m"
+	cfg.Archive.Dir = "archive"
+	cfg.Archive.Retention = Duration{7 * 24 * time.Hour}
+	cfg.Archive.MaxSize = 5 << 30
+	cfg.Archive.EventRadius = 2000
+	cfg.Archive.EventWindow = Duration{30 * time.Minute}
+	cfg.Fuel.Provider = "bencinmonitor"
+	cfg.Fuel.MaxAge = Duration{time.Hour}
+	cfg.Guard.MinEvents = 1
+	cfg.Guard.MinCameras = 1
+	cfg.Guard.MaxDrop = 0.5
+	cfg.Guard.MaxInvalid = 0.2
+	cfg.Guard.MaxRejections = 3
+	return cfg
+}
+
+// LoadConfiguration reads the configuration file and applies environment variable overrides. The result
+// still has to be checked with Validate or ValidateDb.
+func LoadConfiguration(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if err := gcfg.ReadFileInto(cfg, path); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	if err := applyEnvironment(cfg, os.Environ()); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Db.Dsn) == 0 {
+		dbname := cfg.Db.Dbname
+		if len(dbname) == 0 {
+			dbname = "promet_push"
+		}
+
+		cfg.Db.Dsn = fmt.Sprintf("dbname=%s sslmode=disable", dbname)
+	}
+
+	return cfg, nil
+}
+
+// applyEnvironment sets configuration values from PROMET_PUSH_<SECTION>_<VARIABLE> environment variables.
+func applyEnvironment(cfg *Config, environ []string) error {
+	for _, entry := range environ {
+		if !strings.HasPrefix(entry, configEnvPrefix) {
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(entry, configEnvPrefix), "=", 2)
+		names := strings.SplitN(parts[0], "_", 2)
+		if len(parts) != 2 || len(names) != 2 || !configVariableExists(cfg, names[0], names[1]) {
+			// Other tools may share the prefix, so only settings of known variables are enforced.
+			log.WithField("name", configEnvPrefix+parts[0]).Warn("Ignoring unknown configuration environment variable.")
+			continue
+		}
+
+		// Reuse the configuration file parser so values are converted the same way.
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(parts[1])
+		snippet := fmt.Sprintf("[%s]\n%s=\"%s\"\n", strings.ToLower(names[0]), strings.ToLower(names[1]), value)
+		if err := gcfg.ReadStringInto(cfg, snippet); err != nil {
+			return fmt.Errorf("invalid value of %s%s: %v", configEnvPrefix, parts[0], err)
+		}
+	}
+
+	return nil
+}
+
+// configVariableExists checks whether the configuration has a variable in a section, names are case insensitive
+// as in the configuration file.
+func configVariableExists(cfg *Config, section string, name string) bool {
+	sections := reflect.TypeOf(cfg).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		if !strings.EqualFold(sections.Field(i).Name, section) || sections.Field(i).Type.Kind() != reflect.Struct {
+			continue
+		}
+
+		variables := sections.Field(i).Type
+		for j := 0; j < variables.NumField(); j++ {
+			if strings.EqualFold(variables.Field(j).Name, name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ValidateDb checks only the settings needed by commands which work with the database alone.
+func (c *Config) ValidateDb() error {
+	if c.Db.Driver != "postgres" && c.Db.Driver != "sqlite3" {
+		return fmt.Errorf("db.driver must be postgres or sqlite3, got %q", c.Db.Driver)
+	}
+
+	if len(c.Db.Dsn) == 0 {
+		return fmt.Errorf("db.dsn is required")
+	}
+
+	if _, err := log.ParseLevel(c.Log.Level); err != nil {
+		return fmt.Errorf("log.level is invalid: %v", err)
+	}
+
+	return nil
+}
+
+// Validate checks the configuration and returns an error describing the first invalid setting.
+func (c *Config) Validate() error {
+	if err := c.ValidateDb(); err != nil {
+		return err
+	}
+
+	if len(c.Server.Listen) == 0 {
+		return fmt.Errorf("server.listen is required")
+	}
+
+	if c.Server.ShutdownTimeout.Duration < 0 {
+		return fmt.Errorf("server.shutdownTimeout must not be negative")
+	}
+
+	schedules := map[string]string{
+		"schedule.events":     c.Schedule.Events,
+		"schedule.cameras":    c.Schedule.Cameras,
+		"schedule.fuelPrices": c.Schedule.FuelPrices,
+		"archive.schedule":    c.Archive.Schedule,
+	}
+
+	for name, spec := range schedules {
+		if _, err := cron.Parse(spec); err != nil {
+			return fmt.Errorf("%s is not a valid schedule: %v", name, err)
+		}
+	}
+
+	urls := map[string]string{
+		"upstream.eventsUrl":     c.Upstream.EventsUrl,
+		"upstream.camerasUrl":    c.Upstream.CamerasUrl,
+		"upstream.fuelPricesUrl": c.Upstream.FuelPricesUrl,
+	}
+
+	for name, value := range urls {
+		parsed, err := url.Parse(value)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || len(parsed.Host) == 0 {
+			return fmt.Errorf("%s must be an absolute http(s) URL, got %q", name, value)
+		}
+	}
+
+	if c.Upstream.Timeout.Duration <= 0 {
+		return fmt.Errorf("upstream.timeout must be positive")
+	}
+
+	if c.Upstream.RetryCount < 0 {
+		return fmt.Errorf("upstream.retryCount must not be negative")
+	}
+
+	if c.Upstream.RetryDelay.Duration <= 0 {
+		return fmt.Errorf("upstream.retryDelay must be positive")
+	}
+
+	if c.Upstream.MaxBodySize <= 0 {
+		return fmt.Errorf("upstream.maxBodySize must be positive")
+	}
+
+	if c.Upstream.BreakerThreshold < 1 {
+		return fmt.Errorf("upstream.breakerThreshold must be at least 1")
+	}
+
+	if c.Upstream.BreakerCooldown.Duration < 0 {
+		return fmt.Errorf("upstream.breakerCooldown must not be negative")
+	}
+
+	if c.Push.MinTtl.Duration <= 0 || c.Push.MinTtl.Duration > c.Push.DefaultTtl.Duration || c.Push.DefaultTtl.Duration > c.Push.MaxTtl.Duration {
+		return fmt.Errorf("push TTLs must satisfy 0 < minTtl <= defaultTtl <= maxTtl")
+	}
+
+	if c.Push.MaxTtl.Duration > 28*24*time.Hour {
+		return fmt.Errorf("push.maxTtl can't be longer than 4 weeks")
+	}
+
+	if c.Push.RetryCount < 0 {
+		return fmt.Errorf("push.retryCount must not be negative")
+	}
+
+	if c.Push.RetryDelay.Duration <= 0 {
+		return fmt.Errorf("push.retryDelay must be positive")
+	}
+
+	if c.Push.Concurrency < 1 {
+		return fmt.Errorf("push.concurrency must be at least 1")
+	}
+
+	if c.Push.DigestInterval.Duration < time.Second {
+		return fmt.Errorf("push.digestInterval must be at least a second")
+	}
+
+	if c.Push.DrainTimeout.Duration < 0 {
+		return fmt.Errorf("push.drainTimeout must not be negative")
+	}
+
+	if c.Push.ReceiptRetention.Duration <= 0 {
+		return fmt.Errorf("push.receiptRetention must be positive")
+	}
+
+	if c.Push.MaxEventsPerCycle < 1 {
+		return fmt.Errorf("push.maxEventsPerCycle must be at least 1")
+	}
+
+	if c.Cameras.ImageMaxAge.Duration <= 0 {
+		return fmt.Errorf("cameras.imageMaxAge must be positive")
+	}
+
+	if c.Cameras.MemoryCacheSize < 0 || c.Cameras.DiskCacheSize < 0 {
+		return fmt.Errorf("cameras.memoryCacheSize and cameras.diskCacheSize must not be negative")
+	}
+
+	if len(c.Cameras.DiskCacheDir) > 0 {
+		if info, err := os.Stat(c.Cameras.DiskCacheDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("cameras.diskCacheDir must be an existing directory")
+		}
+	}
+
+	if c.Cameras.NearbyRadius < 0 || c.Cameras.NearbyLimit < 0 {
+		return fmt.Errorf("cameras.nearbyRadius and cameras.nearbyLimit must not be negative")
+	}
+
+	if c.Archive.Enabled && len(c.Archive.Dir) == 0 {
+		return fmt.Errorf("archive.dir is required when the archive is enabled")
+	}
+
+	if c.Archive.Retention.Duration <= 0 || c.Archive.MaxSize <= 0 || c.Archive.EventRadius <= 0 || c.Archive.EventWindow.Duration < 0 {
+		return fmt.Errorf("archive.retention, archive.maxSize and archive.eventRadius must be positive")
+	}
+
+	if c.Fuel.Provider != "bencinmonitor" && c.Fuel.Provider != "file" {
+		return fmt.Errorf("fuel.provider must be bencinmonitor or file, got %q", c.Fuel.Provider)
+	}
+
+	if c.Fuel.Provider == "file" && len(c.Fuel.File) == 0 {
+		return fmt.Errorf("fuel.file is required by the file provider")
+	}
+
+	if c.Fuel.MaxAge.Duration <= 0 {
+		return fmt.Errorf("fuel.maxAge must be positive")
+	}
+
+	if c.Guard.MinEvents < 0 || c.Guard.MinCameras < 0 || c.Guard.MaxRejections < 0 {
+		return fmt.Errorf("guard.minEvents, guard.minCameras and guard.maxRejections must not be negative")
+	}
+
+	if c.Guard.MaxDrop < 0 || c.Guard.MaxDrop > 1 || c.Guard.MaxInvalid < 0 || c.Guard.MaxInvalid > 1 {
+		return fmt.Errorf("guard.maxDrop and guard.maxInvalid must be between 0 and 1")
+	}
+
+	return nil
+}
+
+// ValidatePush checks the configuration of commands which send pushes, which also need Firebase credentials.
+func (c *Config) ValidatePush() error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	if len(c.Push.FirebaseJson) == 0 {
+		return fmt.Errorf("push.firebaseJson is required")
+	}
+
+	if _, err := os.Stat(c.Push.FirebaseJson); err != nil {
+		return fmt.Errorf("push.firebaseJson can't be read: %v", err)
+	}
+
+	return nil
+}
+
+// RestartRequired lists settings which differ between configurations, but can't be applied without a restart.
+func RestartRequired(old *Config, new *Config) []string {
+	var changed []string
+	if old.Db != new.Db {
+		changed = append(changed, "db")
+	}
+
+	if old.Server.Listen != new.Server.Listen {
+		changed = append(changed, "server.listen")
+	}
+
+	if old.Push.FirebaseJson != new.Push.FirebaseJson {
+		changed = append(changed, "push.firebaseJson")
+	}
+
+	if old.Cameras.DiskCacheDir != new.Cameras.DiskCacheDir {
+		changed = append(changed, "cameras.diskCacheDir")
+	}
+
+	if old.Push.DigestInterval != new.Push.DigestInterval {
+		changed = append(changed, "push.digestInterval")
+	}
+
+	if old.Archive.Dir != new.Archive.Dir {
+		changed = append(changed, "archive.dir")
+	}
+
+	return changed
+}
+
+var configuration = DefaultConfig()
+var configurationLock sync.RWMutex
+
+// SetConfiguration replaces the configuration used by the service.
+func SetConfiguration(cfg *Config) {
+	configurationLock.Lock()
+	defer configurationLock.Unlock()
+	configuration = cfg
+}
+
+// GetConfiguration returns the current configuration. It must not be modified.
+func GetConfiguration() *Config {
+	configurationLock.RLock()
+	defer configurationLock.RUnlock()
+	return configuration
+}
@@ -0,0 +1,110 @@
+package src
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyEnvironment(t *testing.T) {
+	cfg := DefaultConfig()
+	err := applyEnvironment(cfg, []string{
+		"PATH=/usr/bin",
+		"PROMET_PUSH_DB_DSN=host=db password=\"secret\"",
+		"PROMET_PUSH_PUSH_INDIVIDUALPUSH=true",
+		"PROMET_PUSH_UPSTREAM_TIMEOUT=5s",
+		"PROMET_PUSH_SERVER_SHUTDOWNTIMEOUT=1m",
+		// Unknown variables sharing the prefix are ignored.
+		"PROMET_PUSH_VERSION=1.2",
+		"PROMET_PUSH_DB_UNKNOWN=1",
+		"PROMET_PUSH_UNKNOWN_DSN=1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Db.Dsn != `host=db password="secret"` || !cfg.Push.IndividualPush {
+		t.Errorf("unexpected values %+v %+v", cfg.Db, cfg.Push)
+	}
+
+	if cfg.Upstream.Timeout.Duration != 5*time.Second || cfg.Server.ShutdownTimeout.Duration != time.Minute {
+		t.Errorf("durations weren't parsed, got %v and %v", cfg.Upstream.Timeout, cfg.Server.ShutdownTimeout)
+	}
+
+	if err := applyEnvironment(cfg, []string{"PROMET_PUSH_PUSH_INDIVIDUALPUSH=maybe"}); err == nil {
+		t.Error("invalid value of a known variable was accepted")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "promet_push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	firebaseJson := filepath.Join(dir, "firebase.json")
+	if err := ioutil.WriteFile(firebaseJson, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	valid := func() *Config {
+		cfg := DefaultConfig()
+		cfg.Db.Dsn = "dbname=promet_push"
+		return cfg
+	}
+
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		err    string
+	}{
+		{"defaults", func(cfg *Config) {}, ""},
+		{"driver", func(cfg *Config) { cfg.Db.Driver = "mysql" }, "db.driver"},
+		{"log level", func(cfg *Config) { cfg.Log.Level = "loud" }, "log.level"},
+		{"schedule", func(cfg *Config) { cfg.Schedule.Events = "every now and then" }, "schedule.events"},
+		{"url", func(cfg *Config) { cfg.Upstream.EventsUrl = "/events" }, "upstream.eventsUrl"},
+		{"ttls", func(cfg *Config) { cfg.Push.MinTtl = Duration{3 * time.Hour} }, "push TTLs"},
+		{"max ttl", func(cfg *Config) { cfg.Push.MaxTtl = Duration{30 * 24 * time.Hour} }, "push.maxTtl"},
+		{"events per cycle", func(cfg *Config) { cfg.Push.MaxEventsPerCycle = 0 }, "push.maxEventsPerCycle"},
+		{"fuel file", func(cfg *Config) { cfg.Fuel.Provider = "file" }, "fuel.file"},
+		{"guard", func(cfg *Config) { cfg.Guard.MaxDrop = 1.5 }, "guard.maxDrop"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := valid()
+			test.modify(cfg)
+			err := cfg.Validate()
+			if len(test.err) == 0 && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+
+			if len(test.err) > 0 && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("expected error about %s, got %v", test.err, err)
+			}
+		})
+	}
+
+	// Only commands sending pushes need Firebase credentials.
+	cfg := valid()
+	if err := cfg.ValidatePush(); err == nil || !strings.Contains(err.Error(), "push.firebaseJson") {
+		t.Errorf("missing Firebase credentials weren't reported, got %v", err)
+	}
+
+	cfg.Push.FirebaseJson = firebaseJson
+	if err := cfg.ValidatePush(); err != nil {
+		t.Error(err)
+	}
+
+	if err := os.Remove(firebaseJson); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cfg.ValidatePush(); err == nil {
+		t.Error("unreadable Firebase credentials weren't reported")
+	}
+}
@@ -1,6 +1,8 @@
 package src
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/getsentry/sentry-go"
@@ -8,24 +10,28 @@ import (
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	_ "github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
-	gomigrate "gopkg.in/gormigrate.v1"
 )
 
 type Dogodek struct {
-	Id              string  `json:"Id"`
-	Y_wgs           float64 `json:"y_wgs"`
-	X_wgs           float64 `json:"x_wgs"`
-	Kategorija      string  `json:"Kategorija"`
-	Opis            string  `json:"Description" sql:"type:text"`
-	Cesta           string  `json:"Cesta"`
-	Vzrok           string  `json:"Title"`
-	OpisEn          string
-	CestaEn         string
-	VzrokEn         string
+	Id         string  `json:"Id"`
+	Y_wgs      float64 `json:"y_wgs"`
+	X_wgs      float64 `json:"x_wgs"`
+	Kategorija string  `json:"Kategorija"`
+	Opis       string  `json:"Description" sql:"type:text"`
+	Cesta      string  `json:"Cesta"`
+	Vzrok      string  `json:"Title"`
+	OpisEn     string
+	CestaEn    string
+	VzrokEn    string
+	// Set when the English feed didn't include the event, it's backfilled on the next fetch.
+	EnglishPending  bool  `json:"-" sql:"default:false"`
 	Prioriteta      int32 `json:"Prioriteta"`
 	PrioritetaCeste int32 `json:"PrioritetaCeste"`
 	MejniPrehod     bool  `json:"isMejniPrehod" sql:"default:false"`
-	Vneseno         uint64
+	// Unix time the event was first received at.
+	Vneseno uint64
+	// Cleared once the event drops out of the feed.
+	Active bool `json:"-" sql:"default:false"`
 
 	Updated      uint64
 	VeljavnostOd uint64
@@ -41,74 +47,131 @@ type ApiKey struct {
 	Key              string
 	RegistrationTime int64
 	UserAgent        string
+
+	// Delivery preferences, times are in minutes after midnight in device's timezone.
+	Timezone          string
+	QuietHoursEnabled bool `sql:"default:false"`
+	QuietHoursStart   int
+	QuietHoursEnd     int
+	MaxPushesPerHour  int
+
+	// Event filter, categories are stored as comma separated lists.
+	MinPriority        int32
+	MinRoadPriority    int32
+	Categories         string `sql:"type:text"`
+	ExcludedCategories string `sql:"type:text"`
+	// Fuel types with regulated price change alerts, comma separated.
+	FuelAlerts string `sql:"type:text"`
+
+	// Hourly push counter used for rate limiting.
+	RateWindowStart int64
+	RateWindowCount int
 }
 
-var db *gorm.DB
+// SQLite3 we bundle allows at most 999 variables in a statement.
+const maxStatementVariables = 999
 
-func InitializeDbConnection(debugMode bool) error {
-	var err error
+var db *gorm.DB
 
-	if debugMode {
-		db, err = gorm.Open("sqlite3", "debug.db")
-	} else {
-		db, err = gorm.Open("postgres", "dbname=promet_push sslmode=disable")
+// InitializeDbConnection connects to the configured database and brings its schema up to date.
+func InitializeDbConnection() error {
+	if err := OpenDbConnection(); err != nil {
+		return err
 	}
 
+	return MigrateDatabase()
+}
+
+// OpenDbConnection connects to the database listed in configuration without touching its schema.
+func OpenDbConnection() error {
+	var err error
+
+	config := GetConfiguration().Db
+	db, err = gorm.Open(config.Driver, config.Dsn)
 	if err != nil {
 		sentry.CaptureException(err)
 		log.WithFields(log.Fields{"err": err}).Error("Failed to connect to database.")
-		panic("Could not connect to database!")
+		return err
 	}
 
 	err = db.DB().Ping()
 	if err != nil {
 		sentry.CaptureException(err)
 		log.WithFields(log.Fields{"err": err}).Error("Failed to connect to database.")
-		panic("Could not connect to database!")
+		return err
 	}
 
-	db.DB().SetMaxIdleConns(10)
+	db.DB().SetMaxIdleConns(config.MaxIdleConns)
 
-	db.LogMode(debugMode)
+	db.LogMode(GetConfiguration().Debug.LogQueries)
 	db.SingularTable(true)
+	return nil
+}
 
-	if (!db.HasTable(&ApiKey{})) {
-		db.AutoMigrate(&ApiKey{})
-		db.Model(&ApiKey{}).AddUniqueIndex("idx_api_key", "key")
-	}
+func GetDbConnection() *gorm.DB {
+	return db
+}
 
-	result := db.AutoMigrate(&Dogodek{})
-	if result.Error != nil {
-		sentry.CaptureException(result.Error)
-		log.WithFields(log.Fields{"err": err}).Error("Failed to migrate database!")
-		return result.Error
+// insertRows inserts rows of values of the columns with as few statements as possible.
+func insertRows(tx *gorm.DB, table string, columns []string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
 	}
 
-	// We don't run migrations on SQLite3
-	if debugMode {
-		return nil
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = tx.Dialect().Quote(column)
 	}
 
-	migration := gomigrate.New(db, gomigrate.DefaultOptions, []*gomigrate.Migration{
-		{
-			ID: "201803251900",
-			Migrate: func(tx *gorm.DB) error {
-				return tx.Table("dogodek").ModifyColumn("id", "text").AddIndex("idx_event_id", "id").Error
-			},
-			Rollback: func(tx *gorm.DB) error {
-				return tx.RemoveIndex("idx_event_id").Table("dogodek").ModifyColumn("id", "bigint").Error
-			},
-		},
-	})
-
-	if err = migration.Migrate(); err != nil {
-		log.Fatalf("Could not migrate: %v", err)
-		sentry.CaptureException(err)
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + ")"
+	batchSize := maxStatementVariables / len(columns)
+	for start := 0; start < len(rows); start += batchSize {
+		end := start + batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		values := make([]interface{}, 0, (end-start)*len(columns))
+		for _, row := range rows[start:end] {
+			values = append(values, row...)
+		}
+
+		statement := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", tx.Dialect().Quote(table), strings.Join(quoted, ", "),
+			strings.TrimSuffix(strings.Repeat(placeholders+", ", end-start), ", "))
+		if err := tx.Exec(statement, values...).Error; err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func GetDbConnection() *gorm.DB {
-	return db
+// stringChunks splits ids into chunks of at most size ids.
+func stringChunks(ids []string, size int) [][]string {
+	var chunks [][]string
+	for start := 0; start < len(ids); start += size {
+		end := start + size
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		chunks = append(chunks, ids[start:end])
+	}
+
+	return chunks
+}
+
+// idChunks splits ids into chunks of at most size ids.
+func idChunks(ids []int64, size int) [][]int64 {
+	var chunks [][]int64
+	for start := 0; start < len(ids); start += size {
+		end := start + size
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		chunks = append(chunks, ids[start:end])
+	}
+
+	return chunks
 }
@@ -0,0 +1,141 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// DeviceSettings describes delivery preferences sent by the client app.
+type DeviceSettings struct {
+	Key              string      `json:"key"`
+	Timezone         string      `json:"timezone"`
+	QuietHours       *QuietHours `json:"quiet_hours"`
+	MaxPushesPerHour int         `json:"max_pushes_per_hour"`
+
+	MinPriority        int32    `json:"min_priority"`
+	MinRoadPriority    int32    `json:"min_road_priority"`
+	Categories         []string `json:"categories"`
+	ExcludedCategories []string `json:"excluded_categories"`
+	FuelAlerts         []string `json:"fuel_alerts"`
+}
+
+// QuietHours is a daily window in "HH:MM" format during which no pushes are sent to the device.
+type QuietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+func parseClockTime(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// apply validates the settings and stores them on the passed device registration.
+func (s *DeviceSettings) apply(key *ApiKey) error {
+	if len(s.Timezone) > 0 {
+		if _, err := time.LoadLocation(s.Timezone); err != nil {
+			return fmt.Errorf("unknown timezone %q", s.Timezone)
+		}
+	}
+
+	if s.MaxPushesPerHour < 0 {
+		return fmt.Errorf("max_pushes_per_hour must not be negative")
+	}
+
+	for _, category := range append(s.Categories, s.ExcludedCategories...) {
+		if strings.Contains(category, ",") {
+			return fmt.Errorf("invalid category %q", category)
+		}
+	}
+
+	for _, fuelType := range s.FuelAlerts {
+		if len(fuelType) == 0 || strings.Contains(fuelType, ",") {
+			return fmt.Errorf("invalid fuel type %q", fuelType)
+		}
+	}
+
+	key.Timezone = s.Timezone
+	key.MinPriority = s.MinPriority
+	key.MinRoadPriority = s.MinRoadPriority
+	key.Categories = strings.Join(s.Categories, ",")
+	key.ExcludedCategories = strings.Join(s.ExcludedCategories, ",")
+	key.FuelAlerts = strings.Join(s.FuelAlerts, ",")
+	key.MaxPushesPerHour = s.MaxPushesPerHour
+	key.QuietHoursEnabled = false
+	if s.QuietHours != nil {
+		start, err := parseClockTime(s.QuietHours.Start)
+		if err != nil {
+			return err
+		}
+
+		end, err := parseClockTime(s.QuietHours.End)
+		if err != nil {
+			return err
+		}
+
+		key.QuietHoursEnabled = true
+		key.QuietHoursStart = start
+		key.QuietHoursEnd = end
+	}
+
+	return nil
+}
+
+// UpdateDeviceSettings stores delivery preferences for a registered push target device.
+func UpdateDeviceSettings(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	sentry.ConfigureScope(func(scope *sentry.Scope) {
+		scope.SetContext("Request", map[string]string{
+			"Method": "POST",
+			"URL":    "/settings",
+		})
+	})
+
+	var settings DeviceSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil || len(settings.Key) == 0 {
+		log.WithFields(log.Fields{"err": err}).Warn("Invalid device settings request.")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid settings."))
+		return
+	}
+
+	db := GetDbConnection()
+	tx := db.Begin()
+
+	key, ok := findDeviceByKey(tx, w, settings.Key)
+	if !ok {
+		tx.Rollback()
+		return
+	}
+
+	if err := settings.apply(key); err != nil {
+		tx.Rollback()
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if err := tx.Save(key).Error; err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"err": err}).Error("Failed to save device settings.")
+		tx.Rollback()
+		returnError(w)
+		return
+	}
+
+	tx.Commit()
+	log.WithFields(log.Fields{"apiKey": key.Key, "settings": settings}).Info("Device settings updated.")
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
@@ -4,8 +4,9 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"hash/fnv"
-	"math"
+	"sync"
 	"time"
 
 	firebase "firebase.google.com/go"
@@ -18,7 +19,14 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-const pageSize = 99
+// FCM accepts at most 500 tokens in a single multicast message.
+const pageSize = 500
+
+// There's a payload limit on FCM so only this many last events are sent in a single message.
+const maxPushEvents = 10
+
+// FCM rejects messages with more than 4 KB of data.
+const maxPushDataSize = 4096
 
 // PushEvent describes a single event happening on the road.
 type PushEvent struct {
@@ -35,105 +43,353 @@ type PushEvent struct {
 	Valid         uint64  `json:"validUntil"`
 	Y_wgs         float64 `json:"y_wgs"`
 	X_wgs         float64 `json:"x_wgs"`
+	// Set when the event dropped out of the feed, devices should remove its notification.
+	Cleared bool `json:"cleared,omitempty"`
+	// Only sent when cameras.nearbyInPush is enabled.
+	Cameras []NearbyCamera `json:"cameras,omitempty"`
 }
 
 type pushPayload struct {
 	RegistrationIds []string
 	Events          []PushEvent
+	// Upstream ids of the events, used for delivery reports.
+	EventIds []string
+	// Digest marks a payload collecting events suppressed during quiet hours or rate limiting.
+	Digest bool
 }
 
-// PushDispatcher handles dispatching of notifications to the GCM server. The notifications are coming from the channel
-// listed.
-func PushDispatcher(eventIdsChannel <-chan []string, firebaseConfigurationJSONFile string, individualPushEnabled bool, debugMode bool) {
-	log.WithField("serverApiKey", firebaseConfigurationJSONFile).Debug("Initializing dispatcher.")
-
-	// Paginate apikeys on a page boundary due to GCM server limit
+// PushDispatcher handles dispatching of notifications to the GCM server. The notifications are coming from the channels
+// listed. When ctx is cancelled, the dispatcher sends out events still waiting in the channels for at most
+// push.drainTimeout and returns.
+func PushDispatcher(ctx context.Context, client *messaging.Client, eventIdsChannel <-chan []string, fuelChangesChannel <-chan []FuelPriceChange) {
+	log.Debug("Initializing dispatcher.")
 	db := GetDbConnection()
 
-	opt := option.WithCredentialsFile(firebaseConfigurationJSONFile)
-	ctx := context.Background()
+	// Sends in progress aren't cancelled right away on shutdown, but only once the drain timeout expires.
+	sendCtx, cancelSends := context.WithCancel(context.Background())
+	defer cancelSends()
 
-	var app *firebase.App
-	var client *messaging.Client
-	var err error
+	digestTicker := time.NewTicker(GetConfiguration().Push.DigestInterval.Duration)
+	defer digestTicker.Stop()
+
+	for {
+		select {
+		case ids := <-eventIdsChannel:
+			dispatchEvents(sendCtx, db, ids, client)
+		case changes := <-fuelChangesChannel:
+			dispatchFuelAlerts(sendCtx, db, changes, client)
+		case <-digestTicker.C:
+			if GetConfiguration().Push.IndividualPush {
+				dispatchDigests(sendCtx, db, client)
+			}
+		case <-ctx.Done():
+			drainTimeout := GetConfiguration().Push.DrainTimeout.Duration
+			log.WithField("timeout", drainTimeout).Info("Draining dispatcher queue...")
+			timer := time.AfterFunc(drainTimeout, cancelSends)
+			defer timer.Stop()
+
+			for {
+				select {
+				case ids := <-eventIdsChannel:
+					dispatchEvents(sendCtx, db, ids, client)
+				case changes := <-fuelChangesChannel:
+					dispatchFuelAlerts(sendCtx, db, changes, client)
+				default:
+					log.Info("Dispatcher stopped.")
+					return
+				}
 
-	if app, err = firebase.NewApp(ctx, nil, opt); err != nil {
-		log.WithField("error", err).Fatal("Failed to initialize firebase SDK.")
+				if sendCtx.Err() != nil {
+					log.Warn("Dispatcher drain timed out, dropping queued events.")
+					return
+				}
+			}
+		}
 	}
+}
 
-	if client, err = app.Messaging(ctx); err != nil {
-		log.WithField("error", err).Fatal("Failed to initialize firebase client.")
+// NewMessagingClient initializes the FCM client with credentials listed in configuration.
+func NewMessagingClient(ctx context.Context) (*messaging.Client, error) {
+	opt := option.WithCredentialsFile(GetConfiguration().Push.FirebaseJson)
+	app, err := firebase.NewApp(ctx, nil, opt)
+	if err != nil {
+		return nil, err
 	}
 
+	return app.Messaging(ctx)
+}
+
+// dispatchEvents sends events with the passed ids to topics and registered devices. Every event is sent
+// in its own message, so its collapse key replaces the notification of an earlier version on the device.
+func dispatchEvents(ctx context.Context, db *gorm.DB, ids []string, client *messaging.Client) {
+	log.WithField("ids", ids).Debug("New ids received.")
+	if len(ids) == 0 {
+		return
+	}
+
+	// New events come first, so updates and clearances are skipped before them.
+	config := GetConfiguration()
+	if limit := config.Push.MaxEventsPerCycle; len(ids) > limit {
+		log.WithFields(log.Fields{"num": len(ids), "skipped": ids[limit:]}).Warn("Too many events to push, skipping the rest.")
+		UpdateStatistics(func(s *Statistics) { s.SkippedEvents += len(ids) - limit })
+		ids = ids[:limit]
+	}
+
+	events := loadEvents(db, ids)
+	if events == nil {
+		log.Error("Failed to retrieve data for passed ids")
+		return
+	}
+
+	topics := config.Topic
+	if len(topics) == 0 {
+		topics = map[string]*EventFilter{DefaultTopic: nil}
+	}
+
+	for topic, filter := range topics {
+		topicEvents := filterEvents(filter, events, log.Fields{"topic": topic})
+		if len(topicEvents) == 0 {
+			log.WithField("topic", topic).Debug("No events left for topic after filtering.")
+			continue
+		}
+
+		for _, event := range topicEvents {
+			dispatchPayloadToTopic(ctx, db, topic, []Dogodek{event}, client)
+		}
+	}
+
+	if config.Push.IndividualPush {
+		dispatchToAllDevices(ctx, db, events, client)
+	}
+}
+
+// encodeEvents serializes events into the JSON format expected by client apps.
+func encodeEvents(events []PushEvent) (string, error) {
+	var jsonData bytes.Buffer
+	if err := json.NewEncoder(&jsonData).Encode(events); err != nil {
+		return "", err
+	}
+
+	return jsonData.String(), nil
+}
+
+func dataSize(data map[string]string) int {
+	size := 0
+	for key, value := range data {
+		size += len(key) + len(value)
+	}
+
+	return size
+}
+
+// fitPushData leaves nearby cameras out of the events in data when the message would exceed the FCM limit.
+func fitPushData(data map[string]string, events []PushEvent) error {
+	if dataSize(data) <= maxPushDataSize {
+		return nil
+	}
+
+	withoutCameras := make([]PushEvent, len(events))
+	copy(withoutCameras, events)
+	for i := range withoutCameras {
+		withoutCameras[i].Cameras = nil
+	}
+
+	jsonData, err := encodeEvents(withoutCameras)
+	if err != nil {
+		return err
+	}
+
+	log.WithField("size", dataSize(data)).Warn("Push payload too large, leaving out nearby cameras.")
+	data["events"] = jsonData
+	return nil
+}
+
+// sleepContext waits for the duration and returns false when the context was cancelled before that.
+func sleepContext(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// dispatchToAllDevices walks over all registered devices in pages ordered by id and sends the events to them.
+// Pages are dispatched in parallel, but no database transaction is held open while talking to FCM.
+func dispatchToAllDevices(ctx context.Context, db *gorm.DB, events []Dogodek, client *messaging.Client) {
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, GetConfiguration().Push.Concurrency)
+
+	var lastId int64
 	for {
-		ids := <-eventIdsChannel
-		log.WithField("ids", ids).Debug("New ids received.")
-		if len(ids) == 0 {
+		var apiKeys []ApiKey
+		if err := db.Where("id > ?", lastId).Order("id").Limit(pageSize).Find(&apiKeys).Error; err != nil {
+			log.WithField("error", err).Error("Failed load device tokens")
+			sentry.CaptureException(err)
+			break
+		}
+
+		if len(apiKeys) == 0 {
+			break
+		}
+
+		lastId = apiKeys[len(apiKeys)-1].Id
+
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(apiKeys []ApiKey) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+
+			dispatchToDevices(ctx, db, apiKeys, events, client)
+		}(apiKeys)
+	}
+
+	wg.Wait()
+}
+
+// dispatchToDevices sends events to devices, taking their event filters and delivery preferences into account.
+func dispatchToDevices(ctx context.Context, db *gorm.DB, apiKeys []ApiKey, events []Dogodek, client *messaging.Client) {
+	routes, err := loadRoutes(db, apiKeys)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to load device routes.")
+		sentry.CaptureException(err)
+		return
+	}
+
+	now := time.Now()
+
+	// Each event is multicast to all devices it matches, but the delivery policy is applied to the page
+	// once, so a device either receives all its events or they're all collected for its digest.
+	var matched []*ApiKey
+	matchedEvents := make(map[int64][]string)
+	recipients := make(map[string][]*ApiKey)
+	for i := range apiKeys {
+		apiKey := &apiKeys[i]
+		matching := filterEvents(apiKey.eventFilter(), events, log.Fields{"apiKey": apiKey.Key})
+		if deviceRoutes, ok := routes[apiKey.Id]; ok {
+			matching = filterEventsByRoutes(apiKey, deviceRoutes, matching, now)
+		}
+
+		if len(matching) == 0 {
 			continue
 		}
 
-		tx := db.Begin()
-		data := getData(tx, ids)
-		if data == nil {
-			log.Error("Failed to retrieve data for passed ids")
-			tx.Rollback()
-			return
+		matched = append(matched, apiKey)
+		for _, event := range matching {
+			recipients[event.Id] = append(recipients[event.Id], apiKey)
+			matchedEvents[apiKey.Id] = append(matchedEvents[apiKey.Id], event.Id)
 		}
+	}
 
-		dispatchPayloadToTopic(ctx, data, client, debugMode)
+	deliverable := make(map[int64]bool)
+	for _, apiKey := range filterByDeliveryPolicy(db, matched, matchedEvents, now) {
+		deliverable[apiKey.Id] = true
+	}
 
-		if individualPushEnabled {
-			var keyCount int
-			if err := tx.Model(&ApiKey{}).Count(&keyCount).Error; err != nil {
-				log.WithField("error", err).Error("Failed to check existence of an event.")
-				sentry.CaptureException(err)
-				continue
+	delivered := make(map[int64]bool)
+	for _, event := range events {
+		var keys []string
+		for _, apiKey := range recipients[event.Id] {
+			if deliverable[apiKey.Id] {
+				keys = append(keys, apiKey.Key)
 			}
+		}
 
-			pages := int(math.Ceil(float64(keyCount) / float64(pageSize)))
-
-			for page := 0; page < pages; page++ {
-				// Get list of ApiKeys
-				var keys []string
-				if err := tx.Limit(pageSize).Offset(page*pageSize).Model(&ApiKey{}).Pluck("key", &keys).Error; err != nil {
-					log.WithField("error", err).Error("Failed load device tokens")
-					sentry.CaptureException(err)
-					continue
-				}
+		if len(keys) == 0 {
+			continue
+		}
 
-				log.WithField("num", len(keys)).Info("Dispatching payload...")
-				payload := pushPayload{RegistrationIds: keys}
-				payload.Events = data
-				dispatchPayload(ctx, tx, payload, client, debugMode)
+		log.WithFields(log.Fields{"num": len(keys), "event": event.Id}).Info("Dispatching payload...")
+		payload := pushPayload{RegistrationIds: keys}
+		payload.Events = toPushEvents([]Dogodek{event})
+		payload.EventIds = []string{event.Id}
+		if dispatchPayload(ctx, db, payload, client) {
+			for _, apiKey := range recipients[event.Id] {
+				delivered[apiKey.Id] = delivered[apiKey.Id] || deliverable[apiKey.Id]
 			}
 		}
+	}
 
-		tx.Commit()
+	// A dispatch counts as a single push towards the device's limit, however many events it carried.
+	var sent []*ApiKey
+	for _, apiKey := range matched {
+		if delivered[apiKey.Id] {
+			sent = append(sent, apiKey)
+		}
 	}
+
+	recordDeliveries(db, sent, now)
 }
 
-func getData(tx *gorm.DB, ids []string) []PushEvent {
-	// There's a payload limit on FCM so we need to make sure we don't send too many.
-	if len(ids) > 10 {
-		ids = ids[len(ids)-10:]
+func eventIds(events []Dogodek) []string {
+	ids := make([]string, len(events))
+	for i, event := range events {
+		ids[i] = event.Id
 	}
 
-	events := make([]PushEvent, len(ids))
-	for i := 0; i < len(ids); i++ {
-		var event Dogodek
-		if err := tx.First(&event, "id = ?", ids[i]).Error; err != nil {
-			log.WithFields(log.Fields{"id": ids[i]}).Error("Failed to retrieve event data for dispatch")
+	return ids
+}
+
+func getData(db *gorm.DB, ids []string) []PushEvent {
+	events := loadEvents(db, ids)
+	if events == nil {
+		return nil
+	}
+
+	return toPushEvents(events)
+}
+
+// loadEvents returns events with the passed ids in the same order, or nil when any of them can't be loaded.
+func loadEvents(db *gorm.DB, ids []string) []Dogodek {
+	byId := make(map[string]Dogodek, len(ids))
+	for _, chunk := range stringChunks(ids, maxStatementVariables) {
+		var events []Dogodek
+		if err := db.Where("id IN (?)", chunk).Find(&events).Error; err != nil {
+			log.WithFields(log.Fields{"ids": chunk}).Error("Failed to retrieve event data for dispatch")
 			sentry.CaptureException(err)
 			return nil
 		}
 
+		for _, event := range events {
+			byId[event.Id] = event
+		}
+	}
+
+	events := make([]Dogodek, len(ids))
+	for i, id := range ids {
+		event, ok := byId[id]
+		if !ok {
+			log.WithFields(log.Fields{"id": id}).Error("Failed to retrieve event data for dispatch")
+			sentry.CaptureException(fmt.Errorf("event %s not found", id))
+			return nil
+		}
+
+		events[i] = event
+	}
+
+	return events
+}
+
+func toPushEvents(dogodki []Dogodek) []PushEvent {
+	if len(dogodki) > maxPushEvents {
+		dogodki = dogodki[len(dogodki)-maxPushEvents:]
+	}
+
+	events := make([]PushEvent, len(dogodki))
+	for i, event := range dogodki {
 		var desc string
 		var descEn string
 
 		// Devices won't show description in the notification if
 		// there's more than one incoming so include it only when there's
 		// a single event. This mainly prevents going over the push payload size.
-		if len(ids) == 1 {
+		if len(dogodki) == 1 {
 			desc = event.Opis
 			descEn = event.OpisEn
 		} else {
@@ -158,42 +414,57 @@ func getData(tx *gorm.DB, ids []string) []PushEvent {
 			Description:   desc,
 			DescriptionEn: descEn,
 			Y_wgs:         event.Y_wgs,
-			X_wgs:         event.X_wgs}
+			X_wgs:         event.X_wgs,
+			Cleared:       !event.Active}
+
+		if GetConfiguration().Cameras.NearbyInPush && event.Active {
+			// Camera descriptions are left out to keep the payload small.
+			cameras := nearbyCameras(currentData().cameras, eventPosition(&event), event.Cesta)
+			for j := range cameras {
+				cameras[j].Text = ""
+			}
+
+			events[i].Cameras = cameras
+		}
 	}
 
 	return events
 }
 
-func dispatchPayloadToTopic(ctx context.Context, events []PushEvent, client *messaging.Client, debugMode bool) {
-	log.Debug("Dispatching to topics...")
-	var jsonData bytes.Buffer
-	if err := json.NewEncoder(&jsonData).Encode(events); err != nil {
+func dispatchPayloadToTopic(ctx context.Context, db *gorm.DB, topic string, dogodki []Dogodek, client *messaging.Client) {
+	log.WithField("topic", topic).Debug("Dispatching to topic...")
+	events := toPushEvents(dogodki)
+	jsonData, err := encodeEvents(events)
+	if err != nil {
 		log.WithField("error", err).Error("Failed to encode JSON payload for dispatch.")
 		sentry.CaptureException(err)
 		return
 	}
 
-	var ttl = time.Duration(2) * time.Hour
 	message := &messaging.Message{
 		Data: map[string]string{
-			"events": jsonData.String(),
-		},
-		Topic: "allRoadEvents",
-		Android: &messaging.AndroidConfig{
-			TTL: &ttl,
+			"events": jsonData,
 		},
+		Topic: topic,
 	}
 
-	retryCount := 5
-	retrySecs := 10
+	message.Android, message.APNS, message.Webpush = platformConfigs(events, message.Data, time.Now())
+	if err := fitPushData(message.Data, events); err != nil {
+		log.WithField("error", err).Error("Failed to encode JSON payload for dispatch.")
+		sentry.CaptureException(err)
+		return
+	}
 
-	var err error
+	retryCount := GetConfiguration().Push.RetryCount
+	retryDelay := GetConfiguration().Push.RetryDelay.Duration
+
+	var messageId string
 	for {
-		GetStatistics().Dispatches++
-		if debugMode {
-			_, err = client.SendDryRun(ctx, message)
+		UpdateStatistics(func(s *Statistics) { s.Dispatches++ })
+		if GetConfiguration().Push.DryRun {
+			messageId, err = client.SendDryRun(ctx, message)
 		} else {
-			_, err = client.Send(ctx, message)
+			messageId, err = client.Send(ctx, message)
 		}
 
 		if err == nil {
@@ -205,76 +476,110 @@ func dispatchPayloadToTopic(ctx context.Context, events []PushEvent, client *mes
 		}
 
 		log.WithFields(log.Fields{"err": err, "data": jsonData}).Error("Failed to send topic package.")
-		GetStatistics().FailedDispatches++
+		UpdateStatistics(func(s *Statistics) { s.FailedDispatches++ })
 		sentry.CaptureException(err)
-		time.Sleep(time.Duration(retrySecs) * time.Second)
+		if !sleepContext(ctx, retryDelay) {
+			break
+		}
+
 		retryCount = retryCount - 1
-		retrySecs = retrySecs * 2
+		retryDelay = retryDelay * 2
 	}
 
-	log.Info("Topic dispatch OK.")
+	recordTopicNotification(db, topic, eventIds(dogodki), messageId, err)
+	if err != nil {
+		log.WithFields(log.Fields{"topic": topic, "err": err}).Error("Giving up on topic package.")
+		return
+	}
+
+	log.WithField("topic", topic).Info("Topic dispatch OK.")
 }
 
-func dispatchPayload(ctx context.Context, tx *gorm.DB, payload pushPayload, client *messaging.Client, debugMode bool) {
+// dispatchPayload sends the payload to all listed devices and returns whether FCM accepted the request.
+func dispatchPayload(ctx context.Context, db *gorm.DB, payload pushPayload, client *messaging.Client) bool {
 	log.Debug("Dispatching...")
 
-	var jsonData bytes.Buffer
-	if err := json.NewEncoder(&jsonData).Encode(payload.Events); err != nil {
+	jsonData, err := encodeEvents(payload.Events)
+	if err != nil {
 		log.WithField("error", err).Error("Failed to encode JSON payload for dispatch.")
 		sentry.CaptureException(err)
-		return
+		return false
 	}
 
-	log.WithField("payload", jsonData.String()).Debug("Dispatching pushes.")
+	log.WithField("payload", jsonData).Debug("Dispatching pushes.")
 
-	var ttl = time.Duration(2) * time.Hour
 	message := &messaging.MulticastMessage{
 		Data: map[string]string{
-			"events": jsonData.String(),
+			"events": jsonData,
 		},
 		Tokens: payload.RegistrationIds,
-		Android: &messaging.AndroidConfig{
-			TTL: &ttl,
-		},
 	}
 
-	// Set payload with exponential backoff
-	retryCount := 5
-	retrySecs := 10
+	message.Android, message.APNS, message.Webpush = platformConfigs(payload.Events, message.Data, time.Now())
 
-	var err error
-	var response *messaging.BatchResponse
+	if payload.Digest {
+		message.Data["digest"] = "true"
+	}
 
-	for {
+	if err := fitPushData(message.Data, payload.Events); err != nil {
+		log.WithField("error", err).Error("Failed to encode JSON payload for dispatch.")
+		sentry.CaptureException(err)
+		return false
+	}
+
+	response, err := sendMulticast(ctx, client, message)
+	if err != nil {
+		return false
+	}
+
+	log.WithFields(log.Fields{"success": response.SuccessCount, "failure": response.FailureCount}).Info("Dispatch OK.")
+	kind := notificationDevices
+	if payload.Digest {
+		kind = notificationDigest
+	}
+
+	recordNotification(db, kind, payload.EventIds, response)
+	processResponse(db, payload.RegistrationIds, response)
+	return true
+}
 
-		if debugMode {
+// sendMulticast sends the message with exponential backoff, honoring push.dryRun.
+func sendMulticast(ctx context.Context, client *messaging.Client, message *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
+	retryCount := GetConfiguration().Push.RetryCount
+	retryDelay := GetConfiguration().Push.RetryDelay.Duration
+
+	for {
+		var response *messaging.BatchResponse
+		var err error
+		if GetConfiguration().Push.DryRun {
 			response, err = client.SendMulticastDryRun(ctx, message)
 		} else {
 			response, err = client.SendMulticast(ctx, message)
 		}
 
-		GetStatistics().Dispatches++
+		UpdateStatistics(func(s *Statistics) { s.Dispatches++ })
 		if err == nil {
-			break
+			return response, nil
 		}
 
 		if retryCount <= 0 {
-			break
+			log.WithFields(log.Fields{"err": err, "num": len(message.Tokens)}).Error("Giving up on GCM package.")
+			return nil, err
 		}
 
-		log.WithFields(log.Fields{"err": err, "data": jsonData.String()}).Error("Failed to send GCM package.")
-		GetStatistics().FailedDispatches++
+		log.WithFields(log.Fields{"err": err, "data": message.Data}).Error("Failed to send GCM package.")
+		UpdateStatistics(func(s *Statistics) { s.FailedDispatches++ })
 		sentry.CaptureException(err)
-		time.Sleep(time.Duration(retrySecs) * time.Second)
+		if !sleepContext(ctx, retryDelay) {
+			return nil, ctx.Err()
+		}
+
 		retryCount = retryCount - 1
-		retrySecs = retrySecs * 2
+		retryDelay = retryDelay * 2
 	}
-
-	log.WithFields(log.Fields{"success": response.SuccessCount, "failure": response.FailureCount}).Info("Dispatch OK.")
-	processResponse(tx, payload.RegistrationIds, response)
 }
 
-func processResponse(tx *gorm.DB, registrationIds []string, response *messaging.BatchResponse) {
+func processResponse(db *gorm.DB, registrationIds []string, response *messaging.BatchResponse) {
 	if response.FailureCount == 0 {
 		return
 	}
@@ -285,11 +590,15 @@ func processResponse(tx *gorm.DB, registrationIds []string, response *messaging.
 		}
 
 		log.WithFields(log.Fields{"error": singleResponse.Error, "msg": singleResponse.MessageID}).Warn("Error while dispatching to token.")
-		error := singleResponse.Error
-		GetStatistics().FailedMessages++
-		if messaging.IsRegistrationTokenNotRegistered(error) {
+		sendErr := singleResponse.Error
+		UpdateStatistics(func(s *Statistics) { s.FailedMessages++ })
+		if messaging.IsRegistrationTokenNotRegistered(sendErr) {
 			log.WithField("apiKey", registrationIds[i]).Info("Removing not registered push key.")
-			if err := tx.Where("key = ?", registrationIds[i]).Delete(ApiKey{}).Error; err != nil {
+			err := db.Transaction(func(tx *gorm.DB) error {
+				return deleteApiKey(tx, registrationIds[i])
+			})
+
+			if err != nil {
 				sentry.CaptureException(err)
 			}
 		}
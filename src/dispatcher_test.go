@@ -0,0 +1,73 @@
+package src
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFitPushDataDropsCameras(t *testing.T) {
+	event := PushEvent{Id: 1, Cause: "Zastoj", Description: strings.Repeat("Zastoj pred predorom. ", 60)}
+	for i := 0; i < 60; i++ {
+		event.Cameras = append(event.Cameras, NearbyCamera{LocationId: "location", Index: i, Distance: 1000 + i})
+	}
+
+	events := []PushEvent{event}
+	jsonData, err := encodeEvents(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := map[string]string{"events": jsonData, "tag": "event-1"}
+	if dataSize(data) <= maxPushDataSize {
+		t.Fatalf("test payload of %d bytes is too small", dataSize(data))
+	}
+
+	if err := fitPushData(data, events); err != nil {
+		t.Fatal(err)
+	}
+
+	if dataSize(data) > maxPushDataSize || strings.Contains(data["events"], "cameras") {
+		t.Errorf("cameras weren't left out, got %d bytes", dataSize(data))
+	}
+
+	if len(events[0].Cameras) != 60 {
+		t.Error("passed events were modified")
+	}
+
+	// Payloads within the limit are left alone.
+	small := map[string]string{"events": `[{"id":1}]`}
+	if err := fitPushData(small, events); err != nil || small["events"] != `[{"id":1}]` {
+		t.Errorf("small payload changed to %q, err %v", small["events"], err)
+	}
+}
+
+func TestLoadEventsChunksIds(t *testing.T) {
+	openTestDb(t)
+	if err := MigrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	// More events than fit into a single statement, requested in a different order than stored.
+	now := time.Now()
+	var events []Dogodek
+	var ids []string
+	for i := 0; i < 1200; i++ {
+		events = append(events, Dogodek{Id: fmt.Sprintf("e%d", i), Vzrok: "Zastoj", VeljavnostDo: uint64(now.Add(time.Hour).Unix())})
+		ids = append([]string{events[i].Id}, ids...)
+	}
+
+	if _, err := storeEvents(db, events, nil, now); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := loadEvents(db, ids)
+	if len(loaded) != len(ids) || loaded[0].Id != "e1199" || loaded[len(loaded)-1].Id != "e0" {
+		t.Fatalf("events weren't loaded in the requested order, got %d events", len(loaded))
+	}
+
+	if loadEvents(db, []string{"e1", "missing"}) != nil {
+		t.Error("missing event wasn't reported")
+	}
+}
@@ -0,0 +1,95 @@
+package src
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultTopic is the FCM topic receiving all road events.
+const DefaultTopic = "allRoadEvents"
+
+// EventFilter limits which events are pushed to a device or a topic. Priorities are minimums, so
+// an event needs at least the listed Prioriteta and PrioritetaCeste to pass. Categories match
+// Kategorija of the event, an empty Categories list allows all categories not explicitly excluded.
+type EventFilter struct {
+	MinPriority        int32
+	MinRoadPriority    int32
+	Categories         []string
+	ExcludedCategories []string
+}
+
+// Match checks whether the event passes the filter and returns the reason when it doesn't.
+func (f *EventFilter) Match(event *Dogodek) (bool, string) {
+	if f == nil {
+		return true, ""
+	}
+
+	if event.Prioriteta < f.MinPriority {
+		return false, fmt.Sprintf("priority %d below %d", event.Prioriteta, f.MinPriority)
+	}
+
+	if event.PrioritetaCeste < f.MinRoadPriority {
+		return false, fmt.Sprintf("road priority %d below %d", event.PrioritetaCeste, f.MinRoadPriority)
+	}
+
+	if containsCategory(f.ExcludedCategories, event.Kategorija) {
+		return false, fmt.Sprintf("category %s excluded", event.Kategorija)
+	}
+
+	if len(f.Categories) > 0 && !containsCategory(f.Categories, event.Kategorija) {
+		return false, fmt.Sprintf("category %s not included", event.Kategorija)
+	}
+
+	return true, ""
+}
+
+func containsCategory(categories []string, category string) bool {
+	for _, c := range categories {
+		if strings.EqualFold(c, category) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitCategories parses the comma separated category list stored in the database.
+func splitCategories(value string) []string {
+	var categories []string
+	for _, category := range strings.Split(value, ",") {
+		category = strings.TrimSpace(category)
+		if len(category) > 0 {
+			categories = append(categories, category)
+		}
+	}
+
+	return categories
+}
+
+// eventFilter returns the filter configured for the device.
+func (k *ApiKey) eventFilter() *EventFilter {
+	return &EventFilter{
+		MinPriority:        k.MinPriority,
+		MinRoadPriority:    k.MinRoadPriority,
+		Categories:         splitCategories(k.Categories),
+		ExcludedCategories: splitCategories(k.ExcludedCategories),
+	}
+}
+
+// filterEvents returns the events passing the filter, logging the decision for each rejected event.
+func filterEvents(filter *EventFilter, events []Dogodek, target log.Fields) []Dogodek {
+	matching := make([]Dogodek, 0, len(events))
+	for i := range events {
+		ok, reason := filter.Match(&events[i])
+		if !ok {
+			log.WithFields(target).WithFields(log.Fields{"id": events[i].Id, "reason": reason}).Debug("Event filtered out.")
+			continue
+		}
+
+		matching = append(matching, events[i])
+	}
+
+	return matching
+}
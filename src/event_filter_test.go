@@ -0,0 +1,47 @@
+package src
+
+import "testing"
+
+func TestEventFilterMatch(t *testing.T) {
+	event := Dogodek{Id: "a", Prioriteta: 2, PrioritetaCeste: 3, Kategorija: "Zastoj"}
+	tests := []struct {
+		name     string
+		filter   *EventFilter
+		expected bool
+	}{
+		{"no filter", nil, true},
+		{"empty filter", &EventFilter{}, true},
+		{"priority at minimum", &EventFilter{MinPriority: 2}, true},
+		{"priority below minimum", &EventFilter{MinPriority: 3}, false},
+		{"road priority below minimum", &EventFilter{MinRoadPriority: 4}, false},
+		{"category included", &EventFilter{Categories: []string{"Nesreča", "zastoj"}}, true},
+		{"category not included", &EventFilter{Categories: []string{"Nesreča"}}, false},
+		{"category excluded", &EventFilter{ExcludedCategories: []string{"ZASTOJ"}}, false},
+		{"exclusion wins over inclusion", &EventFilter{Categories: []string{"Zastoj"}, ExcludedCategories: []string{"Zastoj"}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ok, reason := test.filter.Match(&event)
+			if ok != test.expected {
+				t.Errorf("expected %v, got %v (%s)", test.expected, ok, reason)
+			}
+
+			if !ok && len(reason) == 0 {
+				t.Error("rejected event has no reason")
+			}
+		})
+	}
+}
+
+func TestApiKeyEventFilter(t *testing.T) {
+	key := ApiKey{MinPriority: 1, Categories: " Nesreča, ,Zastoj ", ExcludedCategories: ""}
+	filter := key.eventFilter()
+	if len(filter.Categories) != 2 || filter.Categories[0] != "Nesreča" || filter.Categories[1] != "Zastoj" {
+		t.Errorf("unexpected categories %q", filter.Categories)
+	}
+
+	if filter.ExcludedCategories != nil || filter.MinPriority != 1 {
+		t.Errorf("unexpected filter %+v", filter)
+	}
+}
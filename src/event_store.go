@@ -0,0 +1,212 @@
+package src
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// EventChanges lists ids of stored events by what happened to them.
+type EventChanges struct {
+	Inserted  []string
+	Updated   []string
+	Unchanged []string
+	// Events which were in the previous fetch, but dropped out of this one.
+	Cleared []string
+}
+
+// eventChanged compares content of the stored event with the one received from upstream, changed events
+// are pushed again. Whether the event is active and its English translation, which is often filled in
+// by a later fetch, aren't part of its content.
+func eventChanged(stored Dogodek, received Dogodek) bool {
+	stored.Active, stored.EnglishPending = received.Active, received.EnglishPending
+	stored.OpisEn, stored.CestaEn, stored.VzrokEn = received.OpisEn, received.CestaEn, received.VzrokEn
+	return rowChanged(stored, received)
+}
+
+// rowChanged compares all fields of the stored event with the one received from upstream. Time fields
+// are compared through their unix timestamp copies, databases don't preserve time zones.
+func rowChanged(stored Dogodek, received Dogodek) bool {
+	stored.UpdatedTime, stored.VeljavnostOdTime, stored.VeljavnostDoTime = time.Time{}, time.Time{}, time.Time{}
+	received.UpdatedTime, received.VeljavnostOdTime, received.VeljavnostDoTime = time.Time{}, time.Time{}, time.Time{}
+	return stored != received
+}
+
+// keepEnglish fills in English fields of an event missing from the English feed with the stored ones.
+// They stay pending unless the stored translation belongs to the same version of the event.
+func keepEnglish(stored Dogodek, received *Dogodek) {
+	received.OpisEn, received.CestaEn, received.VzrokEn = stored.OpisEn, stored.CestaEn, stored.VzrokEn
+	if stored.Opis == received.Opis && stored.Cesta == received.Cesta && stored.Vzrok == received.Vzrok {
+		received.EnglishPending = stored.EnglishPending
+	}
+}
+
+// storeEvents inserts new and updates changed events with a single upsert per batch. Events
+// appearing multiple times keep the last received version. New events are marked as received at now
+// and active events missing from the passed ones are cleared, unless they're listed in skipped because
+// they were in the feed, but couldn't be used.
+func storeEvents(tx *gorm.DB, events []Dogodek, skipped map[string]bool, now time.Time) (EventChanges, error) {
+	var changes EventChanges
+
+	latest := make(map[string]Dogodek, len(events))
+	var ids []string
+	for _, event := range events {
+		if _, ok := latest[event.Id]; !ok {
+			ids = append(ids, event.Id)
+		}
+
+		event.Active = true
+		latest[event.Id] = event
+	}
+
+	stored := make(map[string]Dogodek, len(ids))
+	for start := 0; start < len(ids); start += maxStatementVariables {
+		end := start + maxStatementVariables
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		var existing []Dogodek
+		if err := tx.Where("id IN (?)", ids[start:end]).Find(&existing).Error; err != nil {
+			return changes, err
+		}
+
+		for _, event := range existing {
+			stored[event.Id] = event
+		}
+	}
+
+	var changed []Dogodek
+	for _, id := range ids {
+		event := latest[id]
+		old, ok := stored[id]
+		if ok && event.EnglishPending {
+			keepEnglish(old, &event)
+		}
+
+		if ok {
+			event.Vneseno = old.Vneseno
+		} else {
+			event.Vneseno = uint64(now.Unix())
+		}
+
+		switch {
+		case !ok:
+			changes.Inserted = append(changes.Inserted, id)
+		case eventChanged(old, event):
+			changes.Updated = append(changes.Updated, id)
+		case rowChanged(old, event):
+			// Translations filled in and events back in the feed without changes, e.g. ones the migration
+			// left inactive, are only written.
+			changes.Unchanged = append(changes.Unchanged, id)
+		default:
+			changes.Unchanged = append(changes.Unchanged, id)
+			continue
+		}
+
+		changed = append(changed, event)
+	}
+
+	if err := upsertEvents(tx, changed); err != nil {
+		return changes, err
+	}
+
+	cleared, err := clearEvents(tx, latest, skipped)
+	changes.Cleared = cleared
+	return changes, err
+}
+
+// clearEvents marks active events which aren't in the received or skipped ones as inactive and returns their ids.
+func clearEvents(tx *gorm.DB, received map[string]Dogodek, skipped map[string]bool) ([]string, error) {
+	var active []string
+	if err := tx.Model(&Dogodek{}).Where("active = ?", true).Pluck("id", &active).Error; err != nil {
+		return nil, err
+	}
+
+	var cleared []string
+	for _, id := range active {
+		if _, ok := received[id]; !ok && !skipped[id] {
+			cleared = append(cleared, id)
+		}
+	}
+
+	for start := 0; start < len(cleared); start += maxStatementVariables - 1 {
+		end := start + maxStatementVariables - 1
+		if end > len(cleared) {
+			end = len(cleared)
+		}
+
+		if err := tx.Model(&Dogodek{}).Where("id IN (?)", cleared[start:end]).Update("active", false).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	return cleared, nil
+}
+
+// upsertEvents writes events with INSERT ... ON CONFLICT, which both Postgres and SQLite3 understand.
+func upsertEvents(tx *gorm.DB, events []Dogodek) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	scope := tx.NewScope(&Dogodek{})
+	var columns []string
+	for _, field := range scope.Fields() {
+		if field.IsNormal && !field.IsIgnored {
+			columns = append(columns, field.DBName)
+		}
+	}
+
+	quoted := make([]string, len(columns))
+	updates := make([]string, 0, len(columns))
+	for i, column := range columns {
+		quoted[i] = scope.Quote(column)
+		if column != "id" {
+			updates = append(updates, fmt.Sprintf("%s = excluded.%s", quoted[i], quoted[i]))
+		}
+	}
+
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + ")"
+	batchSize := maxStatementVariables / len(columns)
+	for start := 0; start < len(events); start += batchSize {
+		end := start + batchSize
+		if end > len(events) {
+			end = len(events)
+		}
+
+		rows := make([]string, 0, end-start)
+		values := make([]interface{}, 0, (end-start)*len(columns))
+		for i := range events[start:end] {
+			rows = append(rows, placeholders)
+			for _, column := range columns {
+				field, _ := tx.NewScope(&events[start+i]).FieldByName(column)
+				values = append(values, field.Field.Interface())
+			}
+		}
+
+		statement := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s ON CONFLICT (%s) DO UPDATE SET %s",
+			scope.QuotedTableName(), strings.Join(quoted, ", "), strings.Join(rows, ", "), scope.Quote("id"), strings.Join(updates, ", "))
+		if err := tx.Exec(statement, values...).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findEvent looks up an event by the upstream id or by the id served in /data.
+func findEvent(db *gorm.DB, id string) (Dogodek, error) {
+	var event Dogodek
+	err := db.Where("id = ?", id).First(&event).Error
+	if hash, parseErr := strconv.ParseInt(id, 10, 64); gorm.IsRecordNotFoundError(err) && parseErr == nil {
+		if upstreamId, ok := currentData().eventIds[hash]; ok {
+			err = db.Where("id = ?", upstreamId).First(&event).Error
+		}
+	}
+
+	return event, err
+}
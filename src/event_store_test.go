@@ -0,0 +1,97 @@
+package src
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStoreEventsClearsMissing(t *testing.T) {
+	openTestDb(t)
+	if err := MigrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	first := Dogodek{Id: "a", Vzrok: "Nesreča", VeljavnostDo: uint64(now.Add(time.Hour).Unix())}
+	second := Dogodek{Id: "b", Vzrok: "Zastoj", VeljavnostDo: uint64(now.Add(time.Hour).Unix())}
+
+	changes, err := storeEvents(db, []Dogodek{first, second}, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(changes.Inserted, []string{"a", "b"}) || len(changes.Cleared) != 0 {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+
+	changes, err = storeEvents(db, []Dogodek{first}, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(changes.Unchanged, []string{"a"}) || !reflect.DeepEqual(changes.Cleared, []string{"b"}) {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+
+	valid, err := loadValidEvents(db, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(valid) != 1 || valid[0].Id != "a" {
+		t.Errorf("cleared event restored, got %+v", valid)
+	}
+
+	// An unchanged event coming back to the feed is only reactivated.
+	changes, err = storeEvents(db, []Dogodek{first, second}, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changes.Updated) != 0 || !reflect.DeepEqual(changes.Unchanged, []string{"a", "b"}) || len(changes.Cleared) != 0 {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+
+	if valid, _ := loadValidEvents(db, now); len(valid) != 2 {
+		t.Errorf("event wasn't reactivated, got %+v", valid)
+	}
+
+	// Events in the feed which couldn't be used aren't cleared.
+	changes, err = storeEvents(db, []Dogodek{first}, map[string]bool{"b": true}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changes.Cleared) != 0 {
+		t.Errorf("skipped event was cleared, got %+v", changes)
+	}
+}
+
+func TestStoreEventsEnglishBackfill(t *testing.T) {
+	openTestDb(t)
+	if err := MigrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	event := Dogodek{Id: "a", Vzrok: "Nesreča", VeljavnostDo: uint64(now.Add(time.Hour).Unix()), EnglishPending: true}
+	if _, err := storeEvents(db, []Dogodek{event}, nil, now); err != nil {
+		t.Fatal(err)
+	}
+
+	event.VzrokEn, event.EnglishPending = "Accident", false
+	changes, err := storeEvents(db, []Dogodek{event}, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changes.Updated) != 0 || !reflect.DeepEqual(changes.Unchanged, []string{"a"}) {
+		t.Errorf("translation reported as an update, got %+v", changes)
+	}
+
+	stored, err := findEvent(db, "a")
+	if err != nil || stored.VzrokEn != "Accident" || stored.EnglishPending {
+		t.Errorf("translation wasn't stored, got %+v, err %v", stored, err)
+	}
+}
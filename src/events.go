@@ -1,11 +1,15 @@
 package src
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"net/http"
+	"errors"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/getsentry/sentry-go"
+	"github.com/jinzhu/gorm"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -14,26 +18,23 @@ type Events struct {
 	events      []Dogodek
 }
 
-func getEvents(english bool) ([]Dogodek, error) {
+func getEvents(ctx context.Context, english bool) ([]Dogodek, *upstreamResponse, error) {
 	log.Debug("Retrieving traffic data...")
-	url := "https://opendata.si/promet/events/"
+	url := GetConfiguration().Upstream.EventsUrl
+	name := "events"
 	if english {
-		url = url + "?lang=en"
-	}
-
-	response, err := http.Get(url)
-	if err != nil {
-		if response != nil {
-			log.WithFields(log.Fields{"status": response.Status, "err": err}).Error("Failed to retrieve data from server.")
+		name = "events-en"
+		if strings.Contains(url, "?") {
+			url = url + "&lang=en"
 		} else {
-			log.WithFields(log.Fields{"err": err}).Error("Failed to retrieve data from server.")
+			url = url + "?lang=en"
 		}
-
-		sentry.CaptureException(err)
-		return nil, err
 	}
 
-	dec := json.NewDecoder(response.Body)
+	response, err := upstream.fetch(ctx, name, url)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	var data struct {
 		Contents []struct {
@@ -43,40 +44,46 @@ func getEvents(english bool) ([]Dogodek, error) {
 		} `json:"Contents"`
 	}
 
-	decodeError := dec.Decode(&data)
-	if decodeError != nil || len(data.Contents) == 0 {
-		buf := new(bytes.Buffer)
-		buf.ReadFrom(response.Body)
-
-		sentry.AddBreadcrumb(&sentry.Breadcrumb{
-			Category: "upstream-api",
-			Message:  buf.String(),
-			Level:    "error",
-		})
-
-		if decodeError != nil {
-			sentry.CaptureException(decodeError)
-		} else {
-			sentry.CaptureMessage("Invalid upstream server response!")
-		}
+	err = json.Unmarshal(response.Body, &data)
+	if err == nil && len(data.Contents) == 0 {
+		err = errors.New("response contains no events")
+	}
 
-		log.Error("Invalid response from server!")
-		return nil, err
+	if err != nil {
+		reportInvalidResponse(response, err)
+		upstream.forget(url)
+		return nil, nil, err
 	}
 
 	items := data.Contents[0].Data.D
-	log.WithFields(log.Fields{"status": response.Status, "num": len(items), "english": english}).Debug("Data retrieval ok.")
-	return items, nil
+	log.WithFields(log.Fields{"status": response.Status, "num": len(items), "english": english, "notModified": response.NotModified}).Debug("Data retrieval ok.")
+	return items, response, nil
 }
 
-func ParseTrafficEvents(eventIdsChannel chan<- []string, eventsChannel chan<- []Dogodek, debugMode bool) {
-	items, err := getEvents(false)
+func ParseTrafficEvents(ctx context.Context, eventIdsChannel chan<- []string, eventsChannel chan<- []Dogodek) {
+	// Both feeds are fetched at the same time, English one is optional.
+	var itemsEn []Dogodek
+	var responseEn *upstreamResponse
+	var errEn error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		itemsEn, responseEn, errEn = getEvents(ctx, true)
+	}()
+
+	items, response, err := getEvents(ctx, false)
+	wg.Wait()
 	if err != nil {
 		return
 	}
 
-	itemsEn, err := getEvents(true)
-	if err != nil {
+	if errEn != nil {
+		log.WithFields(log.Fields{"err": errEn}).Warn("English events unavailable, they'll be filled in on the next fetch.")
+	}
+
+	// Don't start writing to database when shutting down.
+	if ctx.Err() != nil {
 		return
 	}
 
@@ -91,10 +98,11 @@ func ParseTrafficEvents(eventIdsChannel chan<- []string, eventsChannel chan<- []
 	// Save data to database
 	db := GetDbConnection()
 
-	var newEventIds []string
-	var newItems = make([]Dogodek, 0)
+	resendKnown := GetConfiguration().Debug.ResendKnownEvents
 
-	tx := db.Begin()
+	newItems := make([]Dogodek, 0, len(items))
+	var quarantined []QuarantinedItem
+	skipped := make(map[string]bool)
 	for _, item := range items {
 		// Fix up date types
 		item.Updated = uint64(item.UpdatedTime.Unix())
@@ -108,38 +116,90 @@ func ParseTrafficEvents(eventIdsChannel chan<- []string, eventsChannel chan<- []
 			item.OpisEn = itemEn.Opis
 			item.VzrokEn = itemEn.Vzrok
 		} else {
-			log.WithFields(log.Fields{"item": item}).Warn("Couldn't find english item!")
+			item.EnglishPending = true
+			if errEn == nil {
+				log.WithFields(log.Fields{"item": item}).Warn("Couldn't find english item!")
+			}
 		}
 
-		newItems = append(newItems, item)
-
-		var count int
-		if err := tx.Where("id = ?", item.Id).Model(&Dogodek{}).Count(&count).Error; err != nil {
-			sentry.CaptureException(err)
+		if reason := validateEvent(item); len(reason) > 0 {
+			quarantined = append(quarantined, newQuarantinedItem("events", item.Id, reason, item))
+			skipped[item.Id] = true
 			continue
 		}
 
-		log.WithFields(log.Fields{"Count": count, "Id": item.Id}).Debug("Checking event.")
+		newItems = append(newItems, item)
+	}
 
-		if !debugMode && count > 0 {
-			continue
-		}
+	if err := quarantine(db, "events", quarantined); err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Failed to store quarantined events!")
+		sentry.CaptureException(err)
+	}
+
+	// Anomalous fetches don't replace the served events and don't trigger pushes.
+	if err := guard.check("events", len(items), len(newItems), GetConfiguration().Guard.MinEvents); err != nil {
+		return
+	}
 
-		result := tx.Create(&item)
-		if result.Error != nil {
-			log.WithFields(log.Fields{"err": result.Error}).Error("Failed to create item!")
-			sentry.CaptureException(result.Error)
+	// Rows stored by versions before fetches were recorded were never updated, so the first fetch only
+	// brings them up to date. Pushing the differences would notify devices about events they already know.
+	lastFetched, err := lastFetch(db, "events")
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Failed to load last event fetch.")
+		sentry.CaptureException(err)
+		return
+	}
+
+	var changes EventChanges
+	now := time.Now()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if changes, err = storeEvents(tx, newItems, skipped, now); err != nil {
+			return err
 		}
 
-		newEventIds = append(newEventIds, item.Id)
+		recordFetch(tx, "events", now)
+		return nil
+	})
+
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Failed to store events!")
+		sentry.CaptureException(err)
+		return
+	}
+
+	upstream.remember(response)
+	if errEn == nil {
+		upstream.remember(responseEn)
 	}
 
-	result := tx.Commit()
-	if result.Error != nil {
-		sentry.CaptureException(result.Error)
+	UpdateStatistics(func(s *Statistics) {
+		s.InsertedEvents += len(changes.Inserted)
+		s.UpdatedEvents += len(changes.Updated)
+	})
+
+	log.WithFields(log.Fields{"inserted": changes.Inserted, "updated": changes.Updated, "cleared": changes.Cleared, "unchanged": len(changes.Unchanged)}).Debug("Events stored.")
+
+	// Updated and cleared events are pushed again, so devices replace the earlier notification.
+	newEventIds := append(append(append([]string(nil), changes.Inserted...), changes.Updated...), changes.Cleared...)
+	if lastFetched.IsZero() {
+		log.WithField("num", len(newEventIds)).Info("First event fetch, stored events without pushing them.")
+		newEventIds = nil
 	}
 
-	log.WithFields(log.Fields{"num": len(items), "ids": newEventIds}).Info(len(newEventIds), " new events found.")
-	eventIdsChannel <- newEventIds
-	eventsChannel <- newItems
+	if resendKnown {
+		newEventIds = append(newEventIds, changes.Unchanged...)
+	}
+
+	log.WithFields(log.Fields{"num": len(items), "inserted": len(changes.Inserted), "updated": len(changes.Updated), "cleared": len(changes.Cleared)}).Info(len(newEventIds), " new, updated or cleared events found.")
+	select {
+	case eventIdsChannel <- newEventIds:
+	case <-ctx.Done():
+		log.WithField("ids", newEventIds).Warn("Shutting down, new events won't be dispatched.")
+	}
+
+	select {
+	case eventsChannel <- newItems:
+	case <-ctx.Done():
+	}
 }
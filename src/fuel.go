@@ -1,10 +1,15 @@
 package src
 
 import (
+	"context"
 	"encoding/json"
-	"net/http"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
 
 	"github.com/getsentry/sentry-go"
+	"github.com/jinzhu/gorm"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -33,44 +38,264 @@ type JsonGasStationPrice struct {
 	Prices []GasPrice `json:"prices"`
 }
 
-func ParseFuelPrices(pricesChannel chan<- []GasStationPrice) error {
-	log.Debug("Retrieving gas prices data...")
-	url := "https://api.bencinmonitor.si/stations?forMobile=true"
-	response, err := http.Get(url)
-	if err != nil {
-		if response != nil {
-			log.WithFields(log.Fields{"status": response.Status, "err": err}).Error("Failed to retrieve data from server.")
-		} else {
-			log.WithFields(log.Fields{"err": err}).Error("Failed to retrieve data from server.")
-		}
+// FuelStation is the last known description of a gas station.
+type FuelStation struct {
+	Id          string  `json:"id"`
+	Name        string  `json:"name"`
+	Address     string  `json:"address"`
+	X_wgs       float64 `json:"x_wgs"`
+	Y_wgs       float64 `json:"y_wgs"`
+	UpdatedTime int64   `json:"updated"`
+}
 
-		sentry.CaptureException(err)
-		return err
+// FuelPrice is a price of a fuel type at a station, a new row is stored whenever the price changes.
+type FuelPrice struct {
+	Id          int64   `json:"-"`
+	StationId   string  `json:"station_id" sql:"index"`
+	FuelType    string  `json:"type"`
+	Price       float64 `json:"price"`
+	CreatedTime int64   `json:"created"`
+}
+
+type fuelPriceKey struct {
+	StationId string
+	FuelType  string
+}
+
+// FuelPriceProvider retrieves current prices of all gas stations.
+type FuelPriceProvider interface {
+	Name() string
+	FetchPrices(ctx context.Context) ([]GasStationPrice, error)
+}
+
+// NewFuelPriceProvider returns the provider selected in configuration.
+func NewFuelPriceProvider(config FuelConfig) (FuelPriceProvider, error) {
+	switch config.Provider {
+	case "bencinmonitor":
+		return &bencinmonitorProvider{}, nil
+	case "file":
+		return &fileFuelPriceProvider{config.File}, nil
+	default:
+		return nil, fmt.Errorf("unknown fuel price provider %q", config.Provider)
+	}
+}
+
+// bencinmonitorProvider reads prices from the bencinmonitor.si API.
+type bencinmonitorProvider struct{}
+
+func (p *bencinmonitorProvider) Name() string {
+	return "bencinmonitor"
+}
+
+func (p *bencinmonitorProvider) FetchPrices(ctx context.Context) ([]GasStationPrice, error) {
+	response, err := upstream.fetch(ctx, "fuel-prices", GetConfiguration().Upstream.FuelPricesUrl)
+	if err != nil {
+		return nil, err
 	}
 
-	dec := json.NewDecoder(response.Body)
 	var data struct {
 		Stations []JsonGasStationPrice `json:"stations"`
 	}
 
-	dec.Decode(&data)
-	items := data.Stations
+	if err := json.Unmarshal(response.Body, &data); err != nil {
+		reportInvalidResponse(response, err)
+		return nil, err
+	}
 
-	var prices = make([]GasStationPrice, 0)
-	for _, item := range items {
-		price := GasStationPrice{
+	var prices = make([]GasStationPrice, 0, len(data.Stations))
+	for _, item := range data.Stations {
+		// Coordinates are in GeoJSON order, longitude first.
+		if len(item.Key) == 0 || len(item.Location.Coordinates) < 2 {
+			log.WithField("station", item).Warn("Skipping gas station without location.")
+			continue
+		}
+
+		prices = append(prices, GasStationPrice{
 			item.Key,
 			item.Name,
 			item.Address,
 			item.Location.Coordinates[0],
 			item.Location.Coordinates[1],
 			item.Prices,
+		})
+	}
+
+	if len(prices) == 0 {
+		err := fmt.Errorf("no gas stations in response")
+		reportInvalidResponse(response, err)
+		return nil, err
+	}
+
+	upstream.remember(response)
+	return prices, nil
+}
+
+// fileFuelPriceProvider reads prices in /data format from a JSON file, it's meant for development and testing.
+type fileFuelPriceProvider struct {
+	path string
+}
+
+func (p *fileFuelPriceProvider) Name() string {
+	return "file"
+}
+
+func (p *fileFuelPriceProvider) FetchPrices(ctx context.Context) ([]GasStationPrice, error) {
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var prices []GasStationPrice
+	if err := json.Unmarshal(data, &prices); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", p.path, err)
+	}
+
+	return prices, nil
+}
+
+// Time of the last successful fuel price fetch, prices are only served while it's recent enough.
+var fuelPricesUpdated time.Time
+var fuelPricesLock sync.Mutex
+
+// fuelPricesHealthy returns true when prices were retrieved within fuel.maxAge.
+func fuelPricesHealthy() bool {
+	fuelPricesLock.Lock()
+	defer fuelPricesLock.Unlock()
+	return time.Since(fuelPricesUpdated) <= GetConfiguration().Fuel.MaxAge.Duration
+}
+
+// ParseFuelPrices retrieves and stores fuel prices and passes them on to be served. Changes of regulated prices
+// are passed to the dispatcher when fuel alerts are enabled.
+func ParseFuelPrices(ctx context.Context, pricesChannel chan<- []GasStationPrice, fuelChangesChannel chan<- []FuelPriceChange) error {
+	log.Debug("Retrieving gas prices data...")
+	provider, err := NewFuelPriceProvider(GetConfiguration().Fuel)
+	if err != nil {
+		return err
+	}
+
+	prices, err := provider.FetchPrices(ctx)
+	if err != nil {
+		log.WithFields(log.Fields{"provider": provider.Name(), "err": err}).Error("Failed to retrieve gas prices.")
+		sentry.CaptureException(err)
+		return err
+	}
+
+	valid := make([]GasStationPrice, 0, len(prices))
+	for _, station := range prices {
+		if !inSlovenia(station.Y_wgs, station.X_wgs) {
+			log.WithField("station", station).Warn("Skipping gas station outside of Slovenia.")
+			continue
 		}
 
-		prices = append(prices, price)
+		valid = append(valid, station)
+	}
+
+	var changes []FuelPriceChange
+	now := time.Now()
+	err = GetDbConnection().Transaction(func(tx *gorm.DB) error {
+		var err error
+		if changes, err = storeFuelPrices(tx, valid, now); err != nil {
+			return err
+		}
+
+		recordFetch(tx, "fuel-prices", now)
+		return nil
+	})
+
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Failed to store gas prices.")
+		sentry.CaptureException(err)
+		return err
+	}
+
+	fuelPricesLock.Lock()
+	fuelPricesUpdated = now
+	fuelPricesLock.Unlock()
+
+	log.WithFields(log.Fields{"provider": provider.Name(), "num": len(valid)}).Debug("Gas price retrieval ok.")
+	select {
+	case pricesChannel <- valid:
+	case <-ctx.Done():
+	}
+
+	if len(changes) > 0 {
+		log.WithField("changes", changes).Info("Regulated fuel prices changed.")
+		if GetConfiguration().Fuel.Alerts {
+			select {
+			case fuelChangesChannel <- changes:
+			case <-ctx.Done():
+				log.WithField("changes", changes).Warn("Shutting down, fuel alerts won't be dispatched.")
+			}
+		}
 	}
 
-	log.WithFields(log.Fields{"status": response.Status, "num": len(items)}).Debug("Gas price retrieval ok.")
-	pricesChannel <- prices
 	return nil
 }
+
+// fetchedFuelStations returns stations included in the fetch at time fetched, stations which dropped
+// out of the feed keep their last update time.
+func fetchedFuelStations(db *gorm.DB, fetched time.Time) ([]FuelStation, error) {
+	var stations []FuelStation
+	err := db.Where("updated_time >= ?", fetched.Unix()).Order("id").Find(&stations).Error
+	return stations, err
+}
+
+// storeFuelPrices updates stations, records prices which changed since the last fetch and returns
+// changes of regulated prices. Regulated prices are compared between stations of the previous and this fetch.
+func storeFuelPrices(tx *gorm.DB, prices []GasStationPrice, now time.Time) ([]FuelPriceChange, error) {
+	latest, err := latestFuelPrices(tx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	previous, err := lastFetch(tx, "fuel-prices")
+	if err != nil {
+		return nil, err
+	}
+
+	previousStations, err := fetchedFuelStations(tx, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	fetchedBefore := make(map[string]bool, len(previousStations))
+	for _, station := range previousStations {
+		fetchedBefore[station.Id] = true
+	}
+
+	stored := make(map[fuelPriceKey]float64, len(latest))
+	before := make(map[fuelPriceKey]float64, len(latest))
+	for _, price := range latest {
+		key := fuelPriceKey{price.StationId, price.FuelType}
+		stored[key] = price.Price
+		if fetchedBefore[price.StationId] {
+			before[key] = price.Price
+		}
+	}
+
+	after := make(map[fuelPriceKey]float64, len(before))
+	for _, station := range prices {
+		record := FuelStation{station.Id, station.Name, station.Address, station.X_wgs, station.Y_wgs, now.Unix()}
+		if err := tx.Save(&record).Error; err != nil {
+			return nil, err
+		}
+
+		for _, price := range station.Prices {
+			key := fuelPriceKey{station.Id, price.FuelType}
+			if price.Price <= 0 {
+				continue
+			}
+
+			after[key] = price.Price
+			if old, ok := stored[key]; ok && old == price.Price {
+				continue
+			}
+
+			if err := tx.Create(&FuelPrice{StationId: station.Id, FuelType: price.FuelType, Price: price.Price, CreatedTime: now.Unix()}).Error; err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return regulatedPriceChanges(before, after), nil
+}
@@ -0,0 +1,294 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"firebase.google.com/go/messaging"
+	"github.com/getsentry/sentry-go"
+	"github.com/jinzhu/gorm"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// Regulated prices are shared by most stations outside of motorways. The most common price of a fuel type
+// is considered regulated when at least this many stations and this fraction of stations selling it use it.
+const (
+	minRegulatedStations = 3
+	minRegulatedShare    = 0.25
+)
+
+const defaultCheapestLimit = 10
+
+// FuelPriceChange describes a change of the regulated price of a fuel type.
+type FuelPriceChange struct {
+	FuelType string  `json:"type"`
+	OldPrice float64 `json:"old_price"`
+	NewPrice float64 `json:"new_price"`
+}
+
+// CheapFuelStation is a station with its current price of the requested fuel type.
+type CheapFuelStation struct {
+	Station        FuelStation `json:"station"`
+	Price          float64     `json:"price"`
+	Updated        int64       `json:"updated"`
+	DistanceMeters float64     `json:"distance"`
+}
+
+// regulatedPrices finds regulated prices among prices keyed by station and fuel type.
+func regulatedPrices(prices map[fuelPriceKey]float64) map[string]float64 {
+	counts := make(map[string]map[float64]int)
+	totals := make(map[string]int)
+	for key, price := range prices {
+		if counts[key.FuelType] == nil {
+			counts[key.FuelType] = make(map[float64]int)
+		}
+
+		counts[key.FuelType][price]++
+		totals[key.FuelType]++
+	}
+
+	regulated := make(map[string]float64)
+	for fuelType, priceCounts := range counts {
+		best, bestCount := 0.0, 0
+		for price, count := range priceCounts {
+			if count > bestCount || (count == bestCount && price < best) {
+				best, bestCount = price, count
+			}
+		}
+
+		if bestCount >= minRegulatedStations && float64(bestCount) >= minRegulatedShare*float64(totals[fuelType]) {
+			regulated[fuelType] = best
+		}
+	}
+
+	return regulated
+}
+
+// regulatedPriceChanges compares regulated prices before and after a fetch.
+func regulatedPriceChanges(before map[fuelPriceKey]float64, after map[fuelPriceKey]float64) []FuelPriceChange {
+	old := regulatedPrices(before)
+	var changes []FuelPriceChange
+	for fuelType, price := range regulatedPrices(after) {
+		if oldPrice, ok := old[fuelType]; ok && oldPrice != price {
+			changes = append(changes, FuelPriceChange{fuelType, oldPrice, price})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].FuelType < changes[j].FuelType })
+	return changes
+}
+
+func subscribedToFuelType(key *ApiKey, fuelType string) bool {
+	for _, subscribed := range strings.Split(key.FuelAlerts, ",") {
+		if subscribed == fuelType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dispatchFuelAlerts notifies devices subscribed to fuel types with changed regulated prices. Alerts
+// for devices in quiet hours or over their limit are dropped, digests only collect events.
+func dispatchFuelAlerts(ctx context.Context, db *gorm.DB, changes []FuelPriceChange, client *messaging.Client) {
+	if !GetConfiguration().Push.IndividualPush {
+		log.WithField("changes", changes).Debug("Individual pushes are disabled, not sending fuel alerts.")
+		return
+	}
+
+	now := time.Now()
+	for _, change := range changes {
+		jsonData, err := json.Marshal(change)
+		if err != nil {
+			sentry.CaptureException(err)
+			continue
+		}
+
+		// A newer price of the fuel type replaces the alert on devices, prices are rarely interesting after a few hours.
+		key := "fuel-" + change.FuelType
+		data := map[string]string{"fuel_price": string(jsonData), "tag": key}
+		android, apns, webpush := collapsingConfigs(key, GetConfiguration().Push.DefaultTtl.Duration, now)
+
+		var lastId int64
+		for {
+			var keys []ApiKey
+			if err := db.Where("id > ? AND fuel_alerts <> ''", lastId).Order("id").Limit(pageSize).Find(&keys).Error; err != nil {
+				log.WithField("err", err).Error("Failed to load devices for fuel alerts.")
+				sentry.CaptureException(err)
+				break
+			}
+
+			if len(keys) == 0 {
+				break
+			}
+
+			lastId = keys[len(keys)-1].Id
+			var subscribed []*ApiKey
+			for i := range keys {
+				if subscribedToFuelType(&keys[i], change.FuelType) {
+					subscribed = append(subscribed, &keys[i])
+				}
+			}
+
+			deliverable := filterByDeliveryPolicy(db, subscribed, nil, now)
+			if len(deliverable) == 0 {
+				continue
+			}
+
+			tokens := make([]string, len(deliverable))
+			for i, key := range deliverable {
+				tokens[i] = key.Key
+			}
+
+			message := &messaging.MulticastMessage{
+				Data:    data,
+				Tokens:  tokens,
+				Android: android,
+				APNS:    apns,
+				Webpush: webpush,
+			}
+
+			response, err := sendMulticast(ctx, client, message)
+			if err != nil {
+				continue
+			}
+
+			log.WithFields(log.Fields{"change": change, "success": response.SuccessCount, "failure": response.FailureCount}).Info("Fuel alert dispatch OK.")
+			recordNotification(db, notificationFuel, nil, response)
+			recordDeliveries(db, deliverable, now)
+			processResponse(db, tokens, response)
+		}
+	}
+}
+
+// latestFuelPrices returns the current price of every fuel type at every station, optionally only for one fuel type.
+func latestFuelPrices(db *gorm.DB, fuelType string) ([]FuelPrice, error) {
+	latestIds := db.Model(&FuelPrice{}).Select("MAX(id)")
+	if len(fuelType) > 0 {
+		latestIds = latestIds.Where("fuel_type = ?", fuelType)
+	}
+
+	var prices []FuelPrice
+	err := db.Where("id IN ?", latestIds.Group("station_id, fuel_type").SubQuery()).Find(&prices).Error
+	return prices, err
+}
+
+// ShowFuelPriceHistory returns the price timeline of a station, optionally limited to a fuel type and time.
+func ShowFuelPriceHistory(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	query := GetDbConnection().Where("station_id = ?", ps.ByName("id"))
+	if fuelType := r.URL.Query().Get("type"); len(fuelType) > 0 {
+		query = query.Where("fuel_type = ?", fuelType)
+	}
+
+	if since := r.URL.Query().Get("since"); len(since) > 0 {
+		value, err := strconv.ParseInt(since, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid since, expected unix time."))
+			return
+		}
+
+		query = query.Where("created_time >= ?", value)
+	}
+
+	prices := make([]FuelPrice, 0)
+	if err := query.Order("id").Find(&prices).Error; err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"err": err}).Error("Failed to load fuel price history.")
+		returnError(w)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, prices)
+}
+
+// ShowCheapestFuel returns stations within radius meters of lat, lng ordered by their current price of the fuel type.
+func ShowCheapestFuel(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	params := r.URL.Query()
+	fuelType := params.Get("type")
+	lat, latErr := strconv.ParseFloat(params.Get("lat"), 64)
+	lng, lngErr := strconv.ParseFloat(params.Get("lng"), 64)
+	radius, radiusErr := strconv.ParseFloat(params.Get("radius"), 64)
+	if len(fuelType) == 0 || latErr != nil || lngErr != nil || radiusErr != nil || radius <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Expected type, lat, lng and radius parameters."))
+		return
+	}
+
+	limit := defaultCheapestLimit
+	if value := params.Get("limit"); len(value) > 0 {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid limit."))
+			return
+		}
+
+		limit = parsed
+	}
+
+	db := GetDbConnection()
+	prices, err := latestFuelPrices(db, fuelType)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"err": err}).Error("Failed to load fuel prices.")
+		returnError(w)
+		return
+	}
+
+	// Stations which dropped out of the feed would be listed with stale prices.
+	fetched, err := lastFetch(db, "fuel-prices")
+	if err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"err": err}).Error("Failed to load last fuel price fetch.")
+		returnError(w)
+		return
+	}
+
+	stations, err := fetchedFuelStations(db, fetched)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"err": err}).Error("Failed to load fuel stations.")
+		returnError(w)
+		return
+	}
+
+	stationsById := make(map[string]FuelStation, len(stations))
+	for _, station := range stations {
+		stationsById[station.Id] = station
+	}
+
+	center := LatLng{lat, lng}
+	result := make([]CheapFuelStation, 0)
+	for _, price := range prices {
+		station, ok := stationsById[price.StationId]
+		if !ok {
+			continue
+		}
+
+		distance := distanceMeters(center, LatLng{station.Y_wgs, station.X_wgs})
+		if distance <= radius {
+			result = append(result, CheapFuelStation{station, price.Price, price.CreatedTime, distance})
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Price != result[j].Price {
+			return result[i].Price < result[j].Price
+		}
+
+		return result[i].DistanceMeters < result[j].DistanceMeters
+	})
+
+	if len(result) > limit {
+		result = result[:limit]
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
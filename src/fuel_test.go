@@ -0,0 +1,126 @@
+package src
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fetchFuelFixture runs a fuel price fetch reading prices from testdata/fuel_prices.json.
+func fetchFuelFixture(t *testing.T) ([]GasStationPrice, error) {
+	cfg := *GetConfiguration()
+	cfg.Fuel.Provider = "file"
+	cfg.Fuel.File = "testdata/fuel_prices.json"
+	cfg.Fuel.Alerts = false
+	SetConfiguration(&cfg)
+
+	prices := make(chan []GasStationPrice, 1)
+	if err := ParseFuelPrices(context.Background(), prices, nil); err != nil {
+		return nil, err
+	}
+
+	return <-prices, nil
+}
+
+func TestFileFuelPriceProvider(t *testing.T) {
+	openTestDb(t)
+	if err := MigrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	fuelPricesLock.Lock()
+	fuelPricesUpdated = time.Time{}
+	fuelPricesLock.Unlock()
+	if fuelPricesHealthy() {
+		t.Fatal("prices healthy before the first fetch")
+	}
+
+	prices, err := fetchFuelFixture(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(prices) != 4 {
+		t.Errorf("expected 4 stations in Slovenia, got %d", len(prices))
+	}
+
+	if !fuelPricesHealthy() {
+		t.Error("prices not healthy after a successful fetch")
+	}
+
+	// Unchanged prices don't add history rows.
+	if _, err := fetchFuelFixture(t); err != nil {
+		t.Fatal(err)
+	}
+
+	var stations, history int
+	db.Model(&FuelStation{}).Count(&stations)
+	db.Model(&FuelPrice{}).Count(&history)
+	if stations != 4 || history != 8 {
+		t.Errorf("expected 4 stations and 8 prices, got %d and %d", stations, history)
+	}
+
+	latest, err := latestFuelPrices(db, "95")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(latest) != 4 || latest[0].Price <= 0 {
+		t.Errorf("unexpected latest prices %+v", latest)
+	}
+
+	// Failed fetches don't extend the time prices are served for.
+	fuelPricesLock.Lock()
+	fuelPricesUpdated = time.Time{}
+	fuelPricesLock.Unlock()
+	if err := db.DropTable(&FuelPrice{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fetchFuelFixture(t); err == nil {
+		t.Error("fetch succeeded without the price table")
+	}
+
+	if fuelPricesHealthy() {
+		t.Error("prices healthy after a failed fetch")
+	}
+}
+
+func TestRegulatedPriceChangesIgnoreDroppedStations(t *testing.T) {
+	openTestDb(t)
+	if err := MigrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	stations := func(price float64, ids ...string) []GasStationPrice {
+		var result []GasStationPrice
+		for _, id := range ids {
+			result = append(result, GasStationPrice{Id: id, Y_wgs: 46.05, X_wgs: 14.5, Prices: []GasPrice{{"95", price}}})
+		}
+
+		return result
+	}
+
+	fetch := func(prices []GasStationPrice, now time.Time) []FuelPriceChange {
+		changes, err := storeFuelPrices(db, prices, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recordFetch(db, "fuel-prices", now)
+		return changes
+	}
+
+	start := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	fetch(stations(1.459, "a", "b", "c"), start)
+
+	// Stations of the previous fetch aren't counted once they drop out of the feed.
+	changes := fetch(stations(1.499, "d", "e", "f"), start.Add(time.Hour))
+	if len(changes) != 1 || changes[0].OldPrice != 1.459 || changes[0].NewPrice != 1.499 {
+		t.Fatalf("expected change from 1.459 to 1.499, got %+v", changes)
+	}
+
+	if changes := fetch(stations(1.499, "d", "e", "f"), start.Add(2*time.Hour)); len(changes) != 0 {
+		t.Errorf("unexpected changes %+v", changes)
+	}
+}
@@ -0,0 +1,134 @@
+package src
+
+import (
+	"errors"
+	"math"
+)
+
+const earthRadiusMeters = 6371000.0
+
+// LatLng is a WGS84 coordinate.
+type LatLng struct {
+	Lat float64
+	Lng float64
+}
+
+// eventPosition returns the position of the event, upstream uses y_wgs for latitude and x_wgs for longitude.
+func eventPosition(event *Dogodek) LatLng {
+	return LatLng{event.Y_wgs, event.X_wgs}
+}
+
+// distanceMeters returns the great circle distance between two coordinates.
+func distanceMeters(a, b LatLng) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLat := lat2 - lat1
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// boundingBox returns the corners of a box containing all points within radius meters of the point,
+// so candidates can be selected with an index before checking their exact distance.
+func boundingBox(point LatLng, radius float64) (LatLng, LatLng) {
+	dLat := radius / (earthRadiusMeters * math.Pi / 180)
+	dLng := 180.0
+	if scale := math.Cos(point.Lat*math.Pi/180) * earthRadiusMeters * math.Pi / 180; scale > 0 {
+		dLng = math.Min(180, radius/scale)
+	}
+
+	return LatLng{point.Lat - dLat, point.Lng - dLng}, LatLng{point.Lat + dLat, point.Lng + dLng}
+}
+
+// distanceToPolylineMeters returns the shortest distance between the point and any segment of the polyline.
+// Segments are projected onto a plane around the point, which is accurate enough for distances within a country.
+func distanceToPolylineMeters(point LatLng, line []LatLng) float64 {
+	if len(line) == 0 {
+		return math.Inf(1)
+	}
+
+	if len(line) == 1 {
+		return distanceMeters(point, line[0])
+	}
+
+	scaleLng := math.Cos(point.Lat*math.Pi/180) * earthRadiusMeters * math.Pi / 180
+	scaleLat := earthRadiusMeters * math.Pi / 180
+	project := func(p LatLng) (float64, float64) {
+		return (p.Lng - point.Lng) * scaleLng, (p.Lat - point.Lat) * scaleLat
+	}
+
+	best := math.Inf(1)
+	for i := 1; i < len(line); i++ {
+		ax, ay := project(line[i-1])
+		bx, by := project(line[i])
+		dx, dy := bx-ax, by-ay
+
+		// Find the closest point on the segment to the origin, which is where the point was projected.
+		t := 0.0
+		if lengthSq := dx*dx + dy*dy; lengthSq > 0 {
+			t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/lengthSq))
+		}
+
+		best = math.Min(best, math.Hypot(ax+t*dx, ay+t*dy))
+	}
+
+	return best
+}
+
+// decodePolyline decodes a line in the Google encoded polyline format with 5 digit precision.
+func decodePolyline(encoded string) ([]LatLng, error) {
+	var points []LatLng
+	var lat, lng int64
+
+	index := 0
+	next := func() (int64, error) {
+		var result int64
+		shift := uint(0)
+		for {
+			if index >= len(encoded) {
+				return 0, errors.New("truncated polyline")
+			}
+
+			b := int64(encoded[index]) - 63
+			index++
+			if b < 0 || b > 63 {
+				return 0, errors.New("invalid character in polyline")
+			}
+
+			result |= (b & 0x1f) << shift
+			shift += 5
+			if b < 0x20 {
+				break
+			}
+
+			if shift > 60 {
+				return 0, errors.New("invalid polyline value")
+			}
+		}
+
+		if result&1 != 0 {
+			return ^(result >> 1), nil
+		}
+
+		return result >> 1, nil
+	}
+
+	for index < len(encoded) {
+		dLat, err := next()
+		if err != nil {
+			return nil, err
+		}
+
+		dLng, err := next()
+		if err != nil {
+			return nil, err
+		}
+
+		lat += dLat
+		lng += dLng
+		points = append(points, LatLng{float64(lat) / 1e5, float64(lng) / 1e5})
+	}
+
+	return points, nil
+}
@@ -0,0 +1,60 @@
+package src
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDecodePolyline(t *testing.T) {
+	// Example from the encoded polyline format documentation.
+	points, err := decodePolyline("_p~iF~ps|U_ulLnnqC_mqNvxq`@")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []LatLng{{38.5, -120.2}, {40.7, -120.95}, {43.252, -126.453}}
+	if len(points) != len(expected) {
+		t.Fatalf("expected %d points, got %v", len(expected), points)
+	}
+
+	for i := range expected {
+		if math.Abs(points[i].Lat-expected[i].Lat) > 1e-6 || math.Abs(points[i].Lng-expected[i].Lng) > 1e-6 {
+			t.Errorf("point %d: expected %v, got %v", i, expected[i], points[i])
+		}
+	}
+
+	for _, invalid := range []string{"_p~iF~ps|", "_p~iF", "_p~iF ps|U"} {
+		if _, err := decodePolyline(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestDistanceToPolylineMeters(t *testing.T) {
+	// A line along the 46th parallel, where a degree of longitude is about 77 km.
+	line := []LatLng{{46, 14}, {46, 15}}
+	tests := []struct {
+		name     string
+		point    LatLng
+		line     []LatLng
+		expected float64
+	}{
+		{"on the line", LatLng{46, 14.5}, line, 0},
+		{"north of the line", LatLng{46.01, 14.5}, line, 1112},
+		{"past the end", LatLng{46, 15.01}, line, 773},
+		{"single point", LatLng{46.01, 14}, line[:1], 1112},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := distanceToPolylineMeters(test.point, test.line)
+			if math.Abs(actual-test.expected) > 5 {
+				t.Errorf("expected about %.0f m, got %.0f m", test.expected, actual)
+			}
+		})
+	}
+
+	if !math.IsInf(distanceToPolylineMeters(LatLng{46, 14}, nil), 1) {
+		t.Error("empty line should be infinitely far")
+	}
+}
@@ -0,0 +1,616 @@
+package src
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+	gomigrate "gopkg.in/gormigrate.v1"
+)
+
+// Migrations define their own copies of models, so later changes of the models in the code
+// don't change what was already applied to existing databases.
+func migrations() []*gomigrate.Migration {
+	return []*gomigrate.Migration{
+		{
+			// Tables created by AutoMigrate before migrations were introduced, so this one has to
+			// leave existing tables alone.
+			ID: "201803250000",
+			Migrate: func(tx *gorm.DB) error {
+				type apiKey struct {
+					Id               int64
+					Key              string
+					RegistrationTime int64
+					UserAgent        string
+				}
+
+				type dogodek struct {
+					Id              string
+					Y_wgs           float64
+					X_wgs           float64
+					Kategorija      string
+					Opis            string `sql:"type:text"`
+					Cesta           string
+					Vzrok           string
+					OpisEn          string
+					CestaEn         string
+					VzrokEn         string
+					Prioriteta      int32
+					PrioritetaCeste int32
+					MejniPrehod     bool `sql:"default:false"`
+					Vneseno         uint64
+
+					Updated      uint64
+					VeljavnostOd uint64
+					VeljavnostDo uint64
+
+					UpdatedTime      time.Time
+					VeljavnostOdTime time.Time
+					VeljavnostDoTime time.Time
+				}
+
+				if err := tx.AutoMigrate(&apiKey{}, &dogodek{}).Error; err != nil {
+					return err
+				}
+
+				return tx.Model(&apiKey{}).AddUniqueIndex("idx_api_key", "key").Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.DropTableIfExists("dogodek", "api_key").Error
+			},
+		},
+		{
+			// SQLite3 can't change column types, but doesn't enforce them either.
+			ID: "201803251900",
+			Migrate: func(tx *gorm.DB) error {
+				if !isSqlite(tx) {
+					if err := tx.Table("dogodek").ModifyColumn("id", "text").Error; err != nil {
+						return err
+					}
+				}
+
+				return tx.Table("dogodek").AddIndex("idx_event_id", "id").Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				if err := tx.Table("dogodek").RemoveIndex("idx_event_id").Error; err != nil || isSqlite(tx) {
+					return err
+				}
+
+				return tx.Table("dogodek").ModifyColumn("id", "bigint").Error
+			},
+		},
+		{
+			// Quiet hours, rate limits and digests of suppressed pushes.
+			ID: "202610190900",
+			Migrate: func(tx *gorm.DB) error {
+				type apiKey struct {
+					Timezone          string
+					QuietHoursEnabled bool `sql:"default:false"`
+					QuietHoursStart   int
+					QuietHoursEnd     int
+					MaxPushesPerHour  int
+					RateWindowStart   int64
+					RateWindowCount   int
+				}
+
+				type suppressedPush struct {
+					Id          int64
+					ApiKeyId    int64  `sql:"index"`
+					EventId     string `sql:"type:text"`
+					CreatedTime int64
+				}
+
+				return tx.AutoMigrate(&apiKey{}, &suppressedPush{}).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				if err := tx.DropTableIfExists("suppressed_push").Error; err != nil {
+					return err
+				}
+
+				return dropColumns(tx, "api_key", "timezone", "quiet_hours_enabled", "quiet_hours_start", "quiet_hours_end",
+					"max_pushes_per_hour", "rate_window_start", "rate_window_count")
+			},
+		},
+		{
+			// Per device event filters.
+			ID: "202610190910",
+			Migrate: func(tx *gorm.DB) error {
+				type apiKey struct {
+					MinPriority        int32
+					MinRoadPriority    int32
+					Categories         string `sql:"type:text"`
+					ExcludedCategories string `sql:"type:text"`
+				}
+
+				return tx.AutoMigrate(&apiKey{}).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return dropColumns(tx, "api_key", "min_priority", "min_road_priority", "categories", "excluded_categories")
+			},
+		},
+		{
+			// Commute routes.
+			ID: "202610190920",
+			Migrate: func(tx *gorm.DB) error {
+				type route struct {
+					Id           int64
+					ApiKeyId     int64 `sql:"index"`
+					Name         string
+					Polyline     string `sql:"type:text"`
+					ActiveFrom   int
+					ActiveTo     int
+					BufferMeters int
+				}
+
+				return tx.AutoMigrate(&route{}).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.DropTableIfExists("route").Error
+			},
+		},
+		{
+			// Events are upserted by id, older versions could store the same event multiple times.
+			ID: "202610191000",
+			Migrate: func(tx *gorm.DB) error {
+				deleteDuplicates := "DELETE FROM dogodek WHERE rowid NOT IN (SELECT MAX(rowid) FROM dogodek GROUP BY id)"
+				if !isSqlite(tx) {
+					deleteDuplicates = "DELETE FROM dogodek a USING dogodek b WHERE a.id = b.id AND a.ctid < b.ctid"
+				}
+
+				if err := tx.Exec(deleteDuplicates).Error; err != nil {
+					return err
+				}
+
+				return tx.Table("dogodek").RemoveIndex("idx_event_id").AddUniqueIndex("idx_event_id", "id").Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Table("dogodek").RemoveIndex("idx_event_id").AddIndex("idx_event_id", "id").Error
+			},
+		},
+		{
+			// English translations missing from the feed.
+			ID: "202610191010",
+			Migrate: func(tx *gorm.DB) error {
+				type dogodek struct {
+					EnglishPending bool `sql:"default:false"`
+				}
+
+				return tx.AutoMigrate(&dogodek{}).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return dropColumns(tx, "dogodek", "english_pending")
+			},
+		},
+		{
+			ID: "202610191020",
+			Migrate: func(tx *gorm.DB) error {
+				type quarantinedItem struct {
+					Id          int64
+					Feed        string `sql:"index"`
+					ItemId      string
+					Reason      string
+					Payload     string `sql:"type:text"`
+					CreatedTime int64
+				}
+
+				return tx.AutoMigrate(&quarantinedItem{}).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.DropTableIfExists("quarantined_item").Error
+			},
+		},
+		{
+			// Gas stations and history of their prices.
+			ID: "202610191030",
+			Migrate: func(tx *gorm.DB) error {
+				type fuelStation struct {
+					Id          string
+					Name        string
+					Address     string
+					X_wgs       float64
+					Y_wgs       float64
+					UpdatedTime int64
+				}
+
+				type fuelPrice struct {
+					Id          int64
+					StationId   string `sql:"index"`
+					FuelType    string
+					Price       float64
+					CreatedTime int64
+				}
+
+				return tx.AutoMigrate(&fuelStation{}, &fuelPrice{}).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.DropTableIfExists("fuel_price", "fuel_station").Error
+			},
+		},
+		{
+			// Fuel price alert subscriptions.
+			ID: "202610191040",
+			Migrate: func(tx *gorm.DB) error {
+				type apiKey struct {
+					FuelAlerts string `sql:"type:text"`
+				}
+
+				if err := tx.AutoMigrate(&apiKey{}).Error; err != nil {
+					return err
+				}
+
+				return tx.Table("fuel_price").AddIndex("idx_fuel_price_type", "fuel_type", "station_id").Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				if err := tx.Table("fuel_price").RemoveIndex("idx_fuel_price_type").Error; err != nil {
+					return err
+				}
+
+				return dropColumns(tx, "api_key", "fuel_alerts")
+			},
+		},
+		{
+			// Camera image archive.
+			ID: "202610191050",
+			Migrate: func(tx *gorm.DB) error {
+				type cameraFrame struct {
+					Id           int64
+					LocationId   string `sql:"index"`
+					CameraIndex  int
+					Path         string
+					ContentType  string
+					Size         int64
+					Hash         string
+					CapturedTime int64 `sql:"index"`
+					X_wgs        float64
+					Y_wgs        float64
+				}
+
+				return tx.AutoMigrate(&cameraFrame{}).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.DropTableIfExists("camera_frame").Error
+			},
+		},
+		{
+			ID: "202610191100",
+			Migrate: func(tx *gorm.DB) error {
+				type camera struct {
+					Id            string
+					LocationId    string `sql:"index"`
+					CameraIndex   int
+					Region        string
+					Text          string
+					ImageURL      string
+					X_wgs         float64
+					Y_wgs         float64
+					Offline       bool
+					Removed       bool
+					FirstSeenTime int64
+					UpdatedTime   int64
+				}
+
+				return tx.AutoMigrate(&camera{}).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.DropTableIfExists("camera").Error
+			},
+		},
+		{
+			ID: "202610191110",
+			Migrate: func(tx *gorm.DB) error {
+				type feedStatus struct {
+					Id          string
+					FetchedTime int64
+				}
+
+				return tx.AutoMigrate(&feedStatus{}).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.DropTableIfExists("feed_status").Error
+			},
+		},
+		{
+			ID: "202610191120",
+			Migrate: func(tx *gorm.DB) error {
+				type statistics struct {
+					Day string `sql:"primary_key"`
+
+					Dispatches       int
+					FailedDispatches int
+					FailedMessages   int
+					UpdatedPushKeys  int
+					SuppressedPushes int
+					DigestDispatches int
+					InsertedEvents   int
+					UpdatedEvents    int
+					QuarantinedItems int
+					AnomalousFetches int
+					AddedCameras     int
+					RemovedCameras   int
+					ChangedCameras   int
+					CameraOutages    int
+
+					DeviceRegistrations          int
+					DeviceUnregistrations        int
+					DeviceUnregistrationsInvalid int
+				}
+
+				return tx.AutoMigrate(&statistics{}).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.DropTableIfExists("statistics").Error
+			},
+		},
+		{
+			ID: "202610191130",
+			Migrate: func(tx *gorm.DB) error {
+				type notification struct {
+					Id           int64
+					Kind         string
+					Topic        string
+					Recipients   int
+					SuccessCount int
+					FailureCount int
+					Errors       string `sql:"type:text"`
+					CreatedTime  int64  `sql:"index"`
+				}
+
+				type notificationEvent struct {
+					NotificationId int64  `sql:"primary_key;auto_increment:false"`
+					EventId        string `sql:"primary_key"`
+				}
+
+				type notificationMessage struct {
+					Id             int64
+					NotificationId int64  `sql:"index"`
+					MessageId      string `sql:"index"`
+				}
+
+				type notificationAck struct {
+					Id             int64
+					NotificationId int64  `sql:"index"`
+					MessageId      string `sql:"index"`
+					Status         string
+					CreatedTime    int64
+				}
+
+				if err := tx.AutoMigrate(&notification{}, &notificationEvent{}, &notificationMessage{}, &notificationAck{}).Error; err != nil {
+					return err
+				}
+
+				return tx.Model(&notificationEvent{}).AddIndex("idx_notification_event_event_id", "event_id").Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.DropTableIfExists("notification_ack", "notification_message", "notification_event", "notification").Error
+			},
+		},
+		{
+			// Events which dropped out of the feed. Only the ones still valid are considered to be in
+			// the feed, so the first fetch doesn't clear every event ever stored.
+			ID: "202610191140",
+			Migrate: func(tx *gorm.DB) error {
+				type dogodek struct {
+					Active bool `sql:"default:false"`
+				}
+
+				if err := tx.AutoMigrate(&dogodek{}).Error; err != nil {
+					return err
+				}
+
+				return tx.Table("dogodek").Where("veljavnost_do > ?", time.Now().Unix()).Update("active", true).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return dropColumns(tx, "dogodek", "active")
+			},
+		},
+		{
+			// Events over push.maxEventsPerCycle.
+			ID: "202610191150",
+			Migrate: func(tx *gorm.DB) error {
+				type statistics struct {
+					SkippedEvents int `sql:"default:0"`
+				}
+
+				return tx.AutoMigrate(&statistics{}).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return dropColumns(tx, "statistics", "skipped_events")
+			},
+		},
+		{
+			// Notification acks are unique per recipient and status.
+			ID: "202610191200",
+			Migrate: func(tx *gorm.DB) error {
+				type notificationAck struct {
+					Device string `sql:"default:''"`
+				}
+
+				if err := tx.AutoMigrate(&notificationAck{}).Error; err != nil {
+					return err
+				}
+
+				// Recipients of topic messages weren't recorded, so stored topic acks are kept as separate recipients.
+				err := tx.Exec("UPDATE notification_ack SET device = CASE WHEN notification_id IN "+
+					"(SELECT id FROM notification WHERE kind = ?) THEN 'ack-' || CAST(id AS VARCHAR(20)) ELSE message_id END", notificationTopic).Error
+				if err != nil {
+					return err
+				}
+
+				// Device messages were deduplicated by message id and status, but concurrent acks could slip through.
+				err = tx.Exec("DELETE FROM notification_ack WHERE id NOT IN " +
+					"(SELECT MIN(id) FROM notification_ack GROUP BY notification_id, device, status)").Error
+				if err != nil {
+					return err
+				}
+
+				return tx.Table("notification_ack").AddUniqueIndex("idx_notification_ack_device", "notification_id", "device", "status").Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				if err := tx.Table("notification_ack").RemoveIndex("idx_notification_ack_device").Error; err != nil {
+					return err
+				}
+
+				return dropColumns(tx, "notification_ack", "device")
+			},
+		},
+	}
+}
+
+func isSqlite(db *gorm.DB) bool {
+	return db.Dialect().GetName() == "sqlite3"
+}
+
+// dropColumns removes columns from a table. SQLite3 we bundle can't drop columns, so the table is
+// copied without them instead. Indexes of the remaining columns are recreated.
+func dropColumns(tx *gorm.DB, table string, columns ...string) error {
+	if !isSqlite(tx) {
+		for _, column := range columns {
+			if err := tx.Table(table).DropColumn(column).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	var createSql string
+	if err := tx.Raw("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table).Row().Scan(&createSql); err != nil {
+		return err
+	}
+
+	var indexSqls []string
+	if err := tx.Table("sqlite_master").Where("type = 'index' AND tbl_name = ? AND sql IS NOT NULL", table).Pluck("sql", &indexSqls).Error; err != nil {
+		return err
+	}
+
+	rows, err := tx.Raw(fmt.Sprintf("PRAGMA table_info(%q)", table)).Rows()
+	if err != nil {
+		return err
+	}
+
+	dropped := make(map[string]bool)
+	for _, column := range columns {
+		dropped[column] = true
+	}
+
+	var kept, definitions []string
+	for rows.Next() {
+		var cid, notNull, primaryKey int
+		var name, columnType string
+		var defaultValue *string
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			rows.Close()
+			return err
+		}
+
+		if dropped[name] {
+			continue
+		}
+
+		definition := fmt.Sprintf("%q %s", name, columnType)
+		if primaryKey > 0 {
+			definition += " PRIMARY KEY"
+		}
+
+		if notNull > 0 {
+			definition += " NOT NULL"
+		}
+
+		if defaultValue != nil {
+			definition += " DEFAULT " + *defaultValue
+		}
+
+		kept = append(kept, fmt.Sprintf("%q", name))
+		definitions = append(definitions, definition)
+	}
+	rows.Close()
+
+	copied := table + "__old"
+	statements := []string{
+		fmt.Sprintf("ALTER TABLE %q RENAME TO %q", table, copied),
+		fmt.Sprintf("CREATE TABLE %q (%s)", table, strings.Join(definitions, ", ")),
+		fmt.Sprintf("INSERT INTO %q (%s) SELECT %s FROM %q", table, strings.Join(kept, ", "), strings.Join(kept, ", "), copied),
+		fmt.Sprintf("DROP TABLE %q", copied),
+	}
+
+	for _, indexSql := range indexSqls {
+		if !referencesAny(indexSql, columns) {
+			statements = append(statements, indexSql)
+		}
+	}
+
+	for _, statement := range statements {
+		if err := tx.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// referencesAny checks whether the index definition includes any of the columns.
+func referencesAny(indexSql string, columns []string) bool {
+	columnList := indexSql[strings.LastIndex(indexSql, "(")+1:]
+	names := strings.FieldsFunc(columnList, func(r rune) bool {
+		return r == ',' || r == ')' || r == '"' || r == '`' || r == ' '
+	})
+
+	for _, name := range names {
+		for _, column := range columns {
+			if name == column {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// MigrateDatabase runs all pending migrations in order.
+func MigrateDatabase() error {
+	migration := gomigrate.New(db, gomigrate.DefaultOptions, migrations())
+	if err := migration.Migrate(); err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"err": err}).Error("Could not migrate.")
+		return err
+	}
+
+	return nil
+}
+
+// RollbackDatabase reverts the last applied migration.
+func RollbackDatabase() error {
+	return gomigrate.New(db, gomigrate.DefaultOptions, migrations()).RollbackLast()
+}
+
+// MigrationState describes whether a migration was applied to the database.
+type MigrationState struct {
+	ID      string
+	Applied bool
+}
+
+// MigrationStatus lists all known migrations in the order they're applied.
+func MigrationStatus() ([]MigrationState, error) {
+	applied := make(map[string]bool)
+	options := gomigrate.DefaultOptions
+	if db.HasTable(options.TableName) {
+		var ids []string
+		if err := db.Table(options.TableName).Pluck(options.IDColumnName, &ids).Error; err != nil {
+			return nil, err
+		}
+
+		for _, id := range ids {
+			applied[id] = true
+		}
+	}
+
+	var states []MigrationState
+	for _, migration := range migrations() {
+		states = append(states, MigrationState{migration.ID, applied[migration.ID]})
+	}
+
+	return states, nil
+}
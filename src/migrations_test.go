@@ -0,0 +1,121 @@
+package src
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openTestDb connects to an empty SQLite3 database in a temporary directory.
+func openTestDb(t *testing.T) {
+	dir, err := ioutil.TempDir("", "promet_push")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Db.Driver = "sqlite3"
+	cfg.Db.Dsn = filepath.Join(dir, "test.db")
+	SetConfiguration(cfg)
+	if err := OpenDbConnection(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+}
+
+func hasSqliteIndex(t *testing.T, table string, index string) bool {
+	var count int
+	if err := db.Table("sqlite_master").Where("type = 'index' AND tbl_name = ? AND name = ?", table, index).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return count > 0
+}
+
+func TestMigrateUpDownUp(t *testing.T) {
+	openTestDb(t)
+	if err := MigrateDatabase(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	for range migrations() {
+		if err := RollbackDatabase(); err != nil {
+			t.Fatalf("rollback: %v", err)
+		}
+	}
+
+	states, err := MigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, state := range states {
+		if state.Applied {
+			t.Errorf("migration %s still applied after rolling back all", state.ID)
+		}
+	}
+
+	if err := MigrateDatabase(); err != nil {
+		t.Fatalf("migrate again: %v", err)
+	}
+
+	states, err = MigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, state := range states {
+		if !state.Applied {
+			t.Errorf("migration %s pending after migrating again", state.ID)
+		}
+	}
+}
+
+func TestDropColumnsKeepsIndexes(t *testing.T) {
+	openTestDb(t)
+	statements := []string{
+		`CREATE TABLE "item" ("id" integer PRIMARY KEY, "name" varchar(255), "obsolete" varchar(255), "size" integer)`,
+		`CREATE INDEX "idx_item_name" ON "item" ("name")`,
+		`CREATE INDEX "idx_item_obsolete" ON "item" ("obsolete")`,
+		`CREATE UNIQUE INDEX "idx_item_name_size" ON "item" ("name", "size")`,
+		`INSERT INTO "item" ("id", "name", "obsolete", "size") VALUES (1, 'a', 'x', 3)`,
+	}
+
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := dropColumns(db, "item", "obsolete"); err != nil {
+		t.Fatalf("dropColumns: %v", err)
+	}
+
+	if db.Dialect().HasColumn("item", "obsolete") {
+		t.Error("obsolete column wasn't dropped")
+	}
+
+	for _, index := range []string{"idx_item_name", "idx_item_name_size"} {
+		if !hasSqliteIndex(t, "item", index) {
+			t.Errorf("index %s was lost", index)
+		}
+	}
+
+	if hasSqliteIndex(t, "item", "idx_item_obsolete") {
+		t.Error("index of the dropped column was kept")
+	}
+
+	var row struct {
+		Name string
+		Size int
+	}
+
+	if err := db.Table("item").Where("id = 1").Scan(&row).Error; err != nil || row.Name != "a" || row.Size != 3 {
+		t.Errorf("row not copied, got %+v, err %v", row, err)
+	}
+}
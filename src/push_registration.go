@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/getsentry/sentry-go"
+	"github.com/jinzhu/gorm"
 	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
 )
@@ -53,7 +54,7 @@ func RegisterPush(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		}
 
 		log.WithFields(log.Fields{"apiKey": apiKeyStr, "ua": r.UserAgent()}).Info("New API key registered.")
-		GetStatistics().DeviceRegistrations++
+		UpdateStatistics(func(s *Statistics) { s.DeviceRegistrations++ })
 	} else {
 		log.WithFields(log.Fields{"apiKey": apiKeyStr, "ua": r.UserAgent()}).Info("Skipping existing API key.")
 	}
@@ -94,20 +95,19 @@ func UnregisterPush(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 	}
 
 	if count > 0 {
-		query := tx.Where("key = ?", apiKeyStr).Delete(ApiKey{})
-		if query.Error != nil {
-			sentry.CaptureException(query.Error)
-			log.WithFields(log.Fields{"err": query.Error, "apiKey": apiKeyStr, "ua": r.UserAgent()}).Error("Failed to unregister api api key!")
+		if err := deleteApiKey(tx, apiKeyStr); err != nil {
+			sentry.CaptureException(err)
+			log.WithFields(log.Fields{"err": err, "apiKey": apiKeyStr, "ua": r.UserAgent()}).Error("Failed to unregister api api key!")
 			returnError(w)
 			tx.Rollback()
 			return
 		}
 
 		log.WithFields(log.Fields{"apiKey": apiKeyStr, "ua": r.UserAgent()}).Info("Removed API key registration.")
-		GetStatistics().DeviceUnregistrations++
+		UpdateStatistics(func(s *Statistics) { s.DeviceUnregistrations++ })
 	} else {
 		log.WithFields(log.Fields{"apiKey": apiKeyStr, "ua": r.UserAgent()}).Info("API key for removal not found.")
-		GetStatistics().DeviceUnregistrationsInvalid++
+		UpdateStatistics(func(s *Statistics) { s.DeviceUnregistrationsInvalid++ })
 	}
 
 	tx.Commit()
@@ -115,6 +115,20 @@ func UnregisterPush(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 	w.Write([]byte("OK"))
 }
 
+// deleteApiKey removes the device registration together with all data stored for it.
+func deleteApiKey(tx *gorm.DB, apiKeyStr string) error {
+	subQuery := tx.Model(&ApiKey{}).Select("id").Where("key = ?", apiKeyStr).SubQuery()
+	if err := tx.Where("api_key_id IN ?", subQuery).Delete(SuppressedPush{}).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Where("api_key_id IN ?", subQuery).Delete(Route{}).Error; err != nil {
+		return err
+	}
+
+	return tx.Where("key = ?", apiKeyStr).Delete(ApiKey{}).Error
+}
+
 func returnError(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusInternalServerError)
 	w.Write([]byte("Failed to process request."))
@@ -0,0 +1,302 @@
+package src
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"firebase.google.com/go/messaging"
+	"github.com/getsentry/sentry-go"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultTimezone = "Europe/Ljubljana"
+
+// SuppressedPush records an event that wasn't pushed to a device because it was in its quiet hours
+// or over its hourly limit. These get collapsed into a single digest once the device can receive pushes again.
+type SuppressedPush struct {
+	Id          int64
+	ApiKeyId    int64  `sql:"index"`
+	EventId     string `sql:"type:text"`
+	CreatedTime int64
+}
+
+type deliveryDecision int
+
+const (
+	deliverNow deliveryDecision = iota
+	suppressQuietHours
+	suppressRateLimit
+)
+
+func (d deliveryDecision) String() string {
+	switch d {
+	case suppressQuietHours:
+		return "quiet_hours"
+	case suppressRateLimit:
+		return "rate_limit"
+	default:
+		return "deliver"
+	}
+}
+
+// location returns the timezone of the device, falling back to local Slovenian time.
+func (k *ApiKey) location() *time.Location {
+	name := k.Timezone
+	if len(name) == 0 {
+		name = defaultTimezone
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.WithFields(log.Fields{"tz": name, "err": err}).Warn("Unknown device timezone, using local time.")
+		return time.Local
+	}
+
+	return loc
+}
+
+// inQuietHours checks whether the passed time falls into the quiet hours window of the device.
+// Windows wrap around midnight when the start is after the end (e.g. 22:00 - 07:00).
+func (k *ApiKey) inQuietHours(now time.Time) bool {
+	if !k.QuietHoursEnabled || k.QuietHoursStart == k.QuietHoursEnd {
+		return false
+	}
+
+	local := now.In(k.location())
+	minutes := local.Hour()*60 + local.Minute()
+	if k.QuietHoursStart < k.QuietHoursEnd {
+		return minutes >= k.QuietHoursStart && minutes < k.QuietHoursEnd
+	}
+
+	return minutes >= k.QuietHoursStart || minutes < k.QuietHoursEnd
+}
+
+// overRateLimit checks whether the device already received its maximum number of pushes in the current hour.
+func (k *ApiKey) overRateLimit(now time.Time) bool {
+	if k.MaxPushesPerHour <= 0 {
+		return false
+	}
+
+	if now.Unix()-k.RateWindowStart >= int64(time.Hour/time.Second) {
+		return false
+	}
+
+	return k.RateWindowCount >= k.MaxPushesPerHour
+}
+
+// recordPush counts a push towards the hourly limit of the device.
+func (k *ApiKey) recordPush(now time.Time) {
+	if now.Unix()-k.RateWindowStart >= int64(time.Hour/time.Second) {
+		k.RateWindowStart = now.Unix()
+		k.RateWindowCount = 0
+	}
+
+	k.RateWindowCount++
+}
+
+func (k *ApiKey) deliveryDecision(now time.Time) deliveryDecision {
+	if k.inQuietHours(now) {
+		return suppressQuietHours
+	}
+
+	if k.overRateLimit(now) {
+		return suppressRateLimit
+	}
+
+	return deliverNow
+}
+
+// filterByDeliveryPolicy splits the devices into ones that should receive the push right away
+// and stores their events, keyed by device id, for the rest so they can be delivered in a digest later.
+func filterByDeliveryPolicy(db *gorm.DB, keys []*ApiKey, eventIds map[int64][]string, now time.Time) []*ApiKey {
+	deliverable := make([]*ApiKey, 0, len(keys))
+	var suppressed [][]interface{}
+	for _, key := range keys {
+		decision := key.deliveryDecision(now)
+		if decision == deliverNow {
+			deliverable = append(deliverable, key)
+			continue
+		}
+
+		log.WithFields(log.Fields{"apiKey": key.Key, "reason": decision}).Debug("Suppressing push for device.")
+		UpdateStatistics(func(s *Statistics) { s.SuppressedPushes++ })
+		for _, eventId := range eventIds[key.Id] {
+			suppressed = append(suppressed, []interface{}{key.Id, eventId, now.Unix()})
+		}
+	}
+
+	if err := insertRows(db, "suppressed_push", []string{"api_key_id", "event_id", "created_time"}, suppressed); err != nil {
+		log.WithFields(log.Fields{"err": err, "num": len(suppressed)}).Error("Failed to store suppressed pushes.")
+		sentry.CaptureException(err)
+	}
+
+	return deliverable
+}
+
+// recordDeliveries updates hourly push counters of devices with a limit which were sent a push.
+// Devices ending up with the same counter are updated with a single statement.
+func recordDeliveries(db *gorm.DB, keys []*ApiKey, now time.Time) {
+	type window struct {
+		start int64
+		count int
+	}
+
+	windows := make(map[window][]int64)
+	for _, key := range keys {
+		if key.MaxPushesPerHour <= 0 {
+			continue
+		}
+
+		key.recordPush(now)
+		counter := window{key.RateWindowStart, key.RateWindowCount}
+		windows[counter] = append(windows[counter], key.Id)
+	}
+
+	for counter, ids := range windows {
+		// Both counter values are statement variables too.
+		for _, chunk := range idChunks(ids, maxStatementVariables-2) {
+			err := db.Model(&ApiKey{}).Where("id IN (?)", chunk).
+				Updates(map[string]interface{}{"rate_window_start": counter.start, "rate_window_count": counter.count}).Error
+			if err != nil {
+				log.WithFields(log.Fields{"err": err, "num": len(chunk)}).Error("Failed to update push counters.")
+				sentry.CaptureException(err)
+			}
+		}
+	}
+}
+
+// loadSuppressedDevices returns devices with suppressed pushes.
+func loadSuppressedDevices(db *gorm.DB) ([]ApiKey, error) {
+	var keyIds []int64
+	if err := db.Model(&SuppressedPush{}).Pluck("DISTINCT api_key_id", &keyIds).Error; err != nil {
+		return nil, err
+	}
+
+	var keys []ApiKey
+	for _, chunk := range idChunks(keyIds, maxStatementVariables) {
+		var chunkKeys []ApiKey
+		if err := db.Where("id IN (?)", chunk).Find(&chunkKeys).Error; err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, chunkKeys...)
+	}
+
+	return keys, nil
+}
+
+// dispatchDigests sends collapsed notifications of suppressed events to devices which left
+// their quiet hours or rate limit window.
+func dispatchDigests(ctx context.Context, db *gorm.DB, client *messaging.Client) {
+	keys, err := loadSuppressedDevices(db)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to load devices for digest.")
+		sentry.CaptureException(err)
+		return
+	}
+
+	if len(keys) == 0 {
+		return
+	}
+
+	now := time.Now()
+
+	// Devices with the same set of suppressed events can share a single multicast.
+	groups := make(map[string][]*ApiKey)
+	groupEvents := make(map[string][]string)
+	for i := range keys {
+		key := &keys[i]
+		if key.deliveryDecision(now) != deliverNow {
+			continue
+		}
+
+		var eventIds []string
+		if err := db.Model(&SuppressedPush{}).Where("api_key_id = ?", key.Id).Order("id").Pluck("event_id", &eventIds).Error; err != nil {
+			log.WithFields(log.Fields{"error": err, "apiKey": key.Key}).Error("Failed to load suppressed events.")
+			sentry.CaptureException(err)
+			continue
+		}
+
+		eventIds = digestEventIds(eventIds)
+		groupKey := strings.Join(eventIds, ",")
+		groups[groupKey] = append(groups[groupKey], key)
+		groupEvents[groupKey] = eventIds
+	}
+
+	for groupKey, groupKeys := range groups {
+		ids := groupEvents[groupKey]
+		data := getData(db, ids)
+		if data == nil {
+			log.WithField("ids", ids).Error("Failed to retrieve data for digest.")
+			continue
+		}
+
+		for start := 0; start < len(groupKeys); start += pageSize {
+			end := start + pageSize
+			if end > len(groupKeys) {
+				end = len(groupKeys)
+			}
+
+			chunk := groupKeys[start:end]
+			tokens := make([]string, len(chunk))
+			keyIds := make([]int64, len(chunk))
+			for i, key := range chunk {
+				tokens[i] = key.Key
+				keyIds[i] = key.Id
+			}
+
+			log.WithFields(log.Fields{"num": len(tokens), "events": len(groupEvents[groupKey])}).Info("Dispatching digest...")
+			if !dispatchPayload(ctx, db, pushPayload{RegistrationIds: tokens, Events: data, EventIds: ids, Digest: true}, client) {
+				// Suppressed pushes are kept so the digest is retried on next check.
+				continue
+			}
+
+			recordDeliveries(db, chunk, now)
+			if err := db.Where("api_key_id IN (?)", keyIds).Delete(SuppressedPush{}).Error; err != nil {
+				log.WithField("error", err).Error("Failed to clear suppressed pushes.")
+				sentry.CaptureException(err)
+			}
+
+			UpdateStatistics(func(s *Statistics) { s.DigestDispatches++ })
+		}
+	}
+}
+
+// digestEventIds returns ids of events a digest carries from ids of suppressed events in the order they
+// were suppressed. Only the last maxPushEvents distinct events fit into it, the rest are dropped with it.
+func digestEventIds(suppressed []string) []string {
+	last := make(map[string]int, len(suppressed))
+	for i, id := range suppressed {
+		last[id] = i
+	}
+
+	var ids []string
+	for i, id := range suppressed {
+		if last[id] == i {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) > maxPushEvents {
+		ids = ids[len(ids)-maxPushEvents:]
+	}
+
+	return ids
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool)
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		if seen[value] {
+			continue
+		}
+
+		seen[value] = true
+		result = append(result, value)
+	}
+
+	return result
+}
@@ -0,0 +1,186 @@
+package src
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeliveryPolicyBatchesWrites(t *testing.T) {
+	openTestDb(t)
+	if err := MigrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	keys := []ApiKey{
+		{Key: "unlimited"},
+		{Key: "limited", MaxPushesPerHour: 2},
+		{Key: "limited-full", MaxPushesPerHour: 1, RateWindowStart: now.Unix() - 60, RateWindowCount: 1},
+		{Key: "quiet", QuietHoursEnabled: true, QuietHoursStart: 0, QuietHoursEnd: 23*60 + 59, Timezone: "UTC"},
+	}
+
+	for i := range keys {
+		if err := db.Create(&keys[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recipients := make([]*ApiKey, len(keys))
+	for i := range keys {
+		recipients[i] = &keys[i]
+	}
+
+	eventIds := make(map[int64][]string)
+	for _, key := range keys {
+		eventIds[key.Id] = []string{"e1", "e2"}
+	}
+
+	deliverable := filterByDeliveryPolicy(db, recipients, eventIds, now)
+	if len(deliverable) != 2 || deliverable[0].Key != "unlimited" || deliverable[1].Key != "limited" {
+		t.Fatalf("unexpected deliverable devices %v", deliverable)
+	}
+
+	var suppressed []SuppressedPush
+	if err := db.Order("id").Find(&suppressed).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(suppressed) != 4 || suppressed[0].ApiKeyId != keys[2].Id || suppressed[1].EventId != "e2" || suppressed[0].CreatedTime != now.Unix() {
+		t.Errorf("unexpected suppressed pushes %+v", suppressed)
+	}
+
+	recordDeliveries(db, deliverable, now)
+	var stored []ApiKey
+	if err := db.Order("id").Find(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if stored[0].RateWindowCount != 0 || stored[0].RateWindowStart != 0 {
+		t.Errorf("counter of device without limit was updated: %+v", stored[0])
+	}
+
+	if stored[1].RateWindowCount != 1 || stored[1].RateWindowStart != now.Unix() {
+		t.Errorf("counter of limited device wasn't updated: %+v", stored[1])
+	}
+}
+
+func TestLoadSuppressedDevicesChunksIds(t *testing.T) {
+	openTestDb(t)
+	if err := MigrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	// More devices than fit into a single statement.
+	now := time.Now()
+	var rows [][]interface{}
+	for i := 0; i < maxStatementVariables+10; i++ {
+		key := ApiKey{Key: fmt.Sprintf("key-%d", i)}
+		if err := db.Create(&key).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		rows = append(rows, []interface{}{key.Id, "e1", now.Unix()}, []interface{}{key.Id, "e2", now.Unix()})
+	}
+
+	if err := insertRows(db, "suppressed_push", []string{"api_key_id", "event_id", "created_time"}, rows); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := loadSuppressedDevices(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != maxStatementVariables+10 {
+		t.Errorf("expected %d devices, got %d", maxStatementVariables+10, len(keys))
+	}
+}
+
+func TestInQuietHours(t *testing.T) {
+	tests := []struct {
+		name     string
+		key      ApiKey
+		now      time.Time
+		expected bool
+	}{
+		{"disabled", ApiKey{QuietHoursStart: 22 * 60, QuietHoursEnd: 7 * 60, Timezone: "UTC"}, time.Date(2026, 10, 19, 23, 0, 0, 0, time.UTC), false},
+		{"empty window", ApiKey{QuietHoursEnabled: true, QuietHoursStart: 60, QuietHoursEnd: 60, Timezone: "UTC"}, time.Date(2026, 10, 19, 1, 0, 0, 0, time.UTC), false},
+		{"same day inside", ApiKey{QuietHoursEnabled: true, QuietHoursStart: 13 * 60, QuietHoursEnd: 15 * 60, Timezone: "UTC"}, time.Date(2026, 10, 19, 14, 0, 0, 0, time.UTC), true},
+		{"same day end is excluded", ApiKey{QuietHoursEnabled: true, QuietHoursStart: 13 * 60, QuietHoursEnd: 15 * 60, Timezone: "UTC"}, time.Date(2026, 10, 19, 15, 0, 0, 0, time.UTC), false},
+		{"wrapping before midnight", ApiKey{QuietHoursEnabled: true, QuietHoursStart: 22 * 60, QuietHoursEnd: 7 * 60, Timezone: "UTC"}, time.Date(2026, 10, 19, 23, 30, 0, 0, time.UTC), true},
+		{"wrapping after midnight", ApiKey{QuietHoursEnabled: true, QuietHoursStart: 22 * 60, QuietHoursEnd: 7 * 60, Timezone: "UTC"}, time.Date(2026, 10, 19, 6, 59, 0, 0, time.UTC), true},
+		{"wrapping outside", ApiKey{QuietHoursEnabled: true, QuietHoursStart: 22 * 60, QuietHoursEnd: 7 * 60, Timezone: "UTC"}, time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC), false},
+		// 21:30 UTC is 23:30 in Ljubljana during summer time.
+		{"device timezone", ApiKey{QuietHoursEnabled: true, QuietHoursStart: 23 * 60, QuietHoursEnd: 6 * 60, Timezone: "Europe/Ljubljana"}, time.Date(2026, 7, 1, 21, 30, 0, 0, time.UTC), true},
+		{"device timezone outside", ApiKey{QuietHoursEnabled: true, QuietHoursStart: 23 * 60, QuietHoursEnd: 6 * 60, Timezone: "America/New_York"}, time.Date(2026, 7, 1, 23, 30, 0, 0, time.UTC), false},
+		{"default timezone", ApiKey{QuietHoursEnabled: true, QuietHoursStart: 0, QuietHoursEnd: 60}, time.Date(2026, 1, 15, 23, 30, 0, 0, time.UTC), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := test.key.inQuietHours(test.now); actual != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestRateLimitWindow(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		key      ApiKey
+		expected bool
+	}{
+		{"no limit", ApiKey{RateWindowStart: now.Unix() - 60, RateWindowCount: 100}, false},
+		{"under limit", ApiKey{MaxPushesPerHour: 3, RateWindowStart: now.Unix() - 60, RateWindowCount: 2}, false},
+		{"at limit", ApiKey{MaxPushesPerHour: 3, RateWindowStart: now.Unix() - 60, RateWindowCount: 3}, true},
+		{"window expired", ApiKey{MaxPushesPerHour: 3, RateWindowStart: now.Unix() - 3600, RateWindowCount: 3}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := test.key.overRateLimit(now); actual != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+
+	key := ApiKey{MaxPushesPerHour: 2, RateWindowStart: now.Unix() - 3600, RateWindowCount: 2}
+	key.recordPush(now)
+	if key.RateWindowStart != now.Unix() || key.RateWindowCount != 1 {
+		t.Errorf("expired window wasn't restarted: %+v", key)
+	}
+
+	key.recordPush(now.Add(time.Minute))
+	if key.RateWindowStart != now.Unix() || key.RateWindowCount != 2 || !key.overRateLimit(now.Add(time.Minute)) {
+		t.Errorf("push wasn't counted in the window: %+v", key)
+	}
+}
+
+func TestDigestEventIds(t *testing.T) {
+	var many []string
+	for i := 0; i < 15; i++ {
+		many = append(many, fmt.Sprintf("e%d", i))
+	}
+
+	tests := []struct {
+		name       string
+		suppressed []string
+		expected   []string
+	}{
+		{"few", []string{"a", "b"}, []string{"a", "b"}},
+		{"repeated keeps last", []string{"a", "b", "a"}, []string{"b", "a"}},
+		{"truncated to last", many, many[5:]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := digestEventIds(test.suppressed); !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
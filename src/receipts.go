@@ -0,0 +1,325 @@
+package src
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"firebase.google.com/go/messaging"
+	"github.com/getsentry/sentry-go"
+	"github.com/jinzhu/gorm"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// Notification kinds.
+const (
+	notificationTopic   = "topic"
+	notificationDevices = "devices"
+	notificationDigest  = "digest"
+	notificationFuel    = "fuel"
+)
+
+// Notification is a single message sent to FCM, either to a topic or to a batch of devices.
+type Notification struct {
+	Id           int64  `json:"id"`
+	Kind         string `json:"kind"`
+	Topic        string `json:"topic,omitempty"`
+	Recipients   int    `json:"recipients"`
+	SuccessCount int    `json:"success"`
+	FailureCount int    `json:"failure"`
+	// Number of failed recipients by error code, JSON encoded.
+	Errors      string `json:"-" sql:"type:text"`
+	CreatedTime int64  `json:"created" sql:"index"`
+}
+
+// NotificationEvent links a notification to an event it carried.
+type NotificationEvent struct {
+	NotificationId int64  `sql:"primary_key;auto_increment:false"`
+	EventId        string `sql:"primary_key"`
+}
+
+// NotificationMessage is a message id FCM assigned to a recipient of a notification.
+type NotificationMessage struct {
+	Id             int64
+	NotificationId int64  `sql:"index"`
+	MessageId      string `sql:"index"`
+}
+
+// NotificationAck is a receipt reported by a client app. Each recipient acks a status of a notification once.
+type NotificationAck struct {
+	Id             int64
+	NotificationId int64  `sql:"index"`
+	MessageId      string `sql:"index"`
+	// Identifies the recipient, the message id for messages sent to devices and the registration token
+	// reported by the app for topic messages, which share the message id.
+	Device      string `sql:"default:''"`
+	Status      string
+	CreatedTime int64
+}
+
+// DeliveryReport aggregates notifications which carried an event.
+type DeliveryReport struct {
+	EventId       string         `json:"event_id"`
+	Notifications int            `json:"notifications"`
+	Recipients    int            `json:"recipients"`
+	SuccessCount  int            `json:"success"`
+	FailureCount  int            `json:"failure"`
+	Errors        map[string]int `json:"errors"`
+	Received      int            `json:"received"`
+	Opened        int            `json:"opened"`
+}
+
+// errorCode returns the FCM error code of a failed send.
+func errorCode(err error) string {
+	switch {
+	case messaging.IsRegistrationTokenNotRegistered(err):
+		return "registration-token-not-registered"
+	case messaging.IsInvalidArgument(err):
+		return "invalid-argument"
+	case messaging.IsMessageRateExceeded(err):
+		return "message-rate-exceeded"
+	case messaging.IsServerUnavailable(err):
+		return "server-unavailable"
+	case messaging.IsInternal(err):
+		return "internal-error"
+	case messaging.IsMismatchedCredential(err):
+		return "mismatched-credential"
+	case messaging.IsInvalidAPNSCredentials(err):
+		return "invalid-apns-credentials"
+	case messaging.IsTooManyTopics(err):
+		return "too-many-topics"
+	default:
+		return "unknown-error"
+	}
+}
+
+// shortMessageId strips the resource name prefix from message ids returned by FCM, clients only see the last part.
+func shortMessageId(messageId string) string {
+	return messageId[strings.LastIndex(messageId, "/")+1:]
+}
+
+// recordNotification stores the result of a multicast. Failures are only logged, they don't affect delivery.
+func recordNotification(db *gorm.DB, kind string, eventIds []string, response *messaging.BatchResponse) {
+	notification := Notification{
+		Kind:         kind,
+		Recipients:   len(response.Responses),
+		SuccessCount: response.SuccessCount,
+		FailureCount: response.FailureCount,
+		CreatedTime:  time.Now().Unix(),
+	}
+
+	errors := make(map[string]int)
+	var messageIds []string
+	for _, singleResponse := range response.Responses {
+		if singleResponse.Success {
+			messageIds = append(messageIds, shortMessageId(singleResponse.MessageID))
+		} else {
+			errors[errorCode(singleResponse.Error)]++
+		}
+	}
+
+	storeNotification(db, notification, errors, eventIds, messageIds)
+}
+
+// recordTopicNotification stores the result of a send to a topic, the number of recipients isn't known.
+func recordTopicNotification(db *gorm.DB, topic string, eventIds []string, messageId string, err error) {
+	notification := Notification{Kind: notificationTopic, Topic: topic, CreatedTime: time.Now().Unix()}
+	errors := make(map[string]int)
+	var messageIds []string
+	if err != nil {
+		notification.FailureCount = 1
+		errors[errorCode(err)]++
+	} else {
+		notification.SuccessCount = 1
+		messageIds = append(messageIds, shortMessageId(messageId))
+	}
+
+	storeNotification(db, notification, errors, eventIds, messageIds)
+}
+
+func storeNotification(db *gorm.DB, notification Notification, errors map[string]int, eventIds []string, messageIds []string) {
+	errorsJson, _ := json.Marshal(errors)
+	notification.Errors = string(errorsJson)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&notification).Error; err != nil {
+			return err
+		}
+
+		events := make([][]interface{}, 0, len(eventIds))
+		for _, eventId := range uniqueStrings(eventIds) {
+			events = append(events, []interface{}{notification.Id, eventId})
+		}
+
+		if err := insertRows(tx, "notification_event", []string{"notification_id", "event_id"}, events); err != nil {
+			return err
+		}
+
+		messages := make([][]interface{}, len(messageIds))
+		for i, messageId := range messageIds {
+			messages[i] = []interface{}{notification.Id, messageId}
+		}
+
+		return insertRows(tx, "notification_message", []string{"notification_id", "message_id"}, messages)
+	})
+
+	if err != nil {
+		log.WithFields(log.Fields{"err": err, "kind": notification.Kind}).Error("Failed to record notification.")
+		sentry.CaptureException(err)
+	}
+}
+
+// PruneNotifications removes notifications older than push.receiptRetention.
+func PruneNotifications() {
+	db := GetDbConnection()
+	before := time.Now().Add(-GetConfiguration().Push.ReceiptRetention.Duration).Unix()
+	expired := db.Model(&Notification{}).Select("id").Where("created_time < ?", before).SubQuery()
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&NotificationEvent{}, &NotificationMessage{}, &NotificationAck{}} {
+			if err := tx.Where("notification_id IN ?", expired).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Where("created_time < ?", before).Delete(&Notification{}).Error
+	})
+
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Failed to prune notifications.")
+		sentry.CaptureException(err)
+	}
+}
+
+// AcknowledgeNotification records that a client app received or opened a notification, identified by the
+// message id it was delivered with.
+func AcknowledgeNotification(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var ack struct {
+		MessageId string `json:"message_id"`
+		Status    string `json:"status"`
+		// Registration token of the device, required for topic messages.
+		Key string `json:"key"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&ack); err != nil || len(ack.MessageId) == 0 ||
+		(ack.Status != "received" && ack.Status != "opened") {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Expected message_id and status, which is received or opened."))
+		return
+	}
+
+	db := GetDbConnection()
+	messageId := shortMessageId(ack.MessageId)
+	var message NotificationMessage
+	if err := db.Where("message_id = ?", messageId).First(&message).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		sentry.CaptureException(err)
+		returnError(w)
+		return
+	}
+
+	var notification Notification
+	if err := db.Where("id = ?", message.NotificationId).First(&notification).Error; err != nil {
+		sentry.CaptureException(err)
+		returnError(w)
+		return
+	}
+
+	// Messages sent to a topic share the id, so their recipients are told apart by the token.
+	device := messageId
+	if notification.Kind == notificationTopic {
+		if len(ack.Key) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Expected key for topic messages."))
+			return
+		}
+
+		device = ack.Key
+	}
+
+	// Repeated acks are ignored by the unique index on notification, device and status.
+	err := db.Exec("INSERT INTO notification_ack (notification_id, message_id, device, status, created_time) "+
+		"VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING", notification.Id, messageId, device, ack.Status, time.Now().Unix()).Error
+	if err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"err": err}).Error("Failed to save notification ack.")
+		returnError(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// ShowEventDeliveries reports how notifications carrying the event were delivered. Events can be passed by
+// the upstream id or by the id served in /data.
+func ShowEventDeliveries(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	db := GetDbConnection()
+	event, err := findEvent(db, ps.ByName("id"))
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		sentry.CaptureException(err)
+		returnError(w)
+		return
+	}
+
+	notificationIds := db.Model(&NotificationEvent{}).Select("notification_id").Where("event_id = ?", event.Id).SubQuery()
+	var notifications []Notification
+	if err := db.Where("id IN ?", notificationIds).Find(&notifications).Error; err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"err": err}).Error("Failed to load notifications.")
+		returnError(w)
+		return
+	}
+
+	report := DeliveryReport{EventId: event.Id, Notifications: len(notifications), Errors: make(map[string]int)}
+	for _, notification := range notifications {
+		report.Recipients += notification.Recipients
+		report.SuccessCount += notification.SuccessCount
+		report.FailureCount += notification.FailureCount
+
+		var errors map[string]int
+		if err := json.Unmarshal([]byte(notification.Errors), &errors); err == nil {
+			for code, count := range errors {
+				report.Errors[code] += count
+			}
+		}
+	}
+
+	rows, err := db.Model(&NotificationAck{}).Select("status, COUNT(*)").Where("notification_id IN ?", notificationIds).Group("status").Rows()
+	if err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"err": err}).Error("Failed to load notification acks.")
+		returnError(w)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			sentry.CaptureException(err)
+			returnError(w)
+			return
+		}
+
+		switch status {
+		case "received":
+			report.Received = count
+		case "opened":
+			report.Opened = count
+		}
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,88 @@
+package src
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"firebase.google.com/go/messaging"
+)
+
+func TestRecordNotificationBatchesMessages(t *testing.T) {
+	openTestDb(t)
+	if err := MigrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	// More messages than fit into a single statement.
+	response := &messaging.BatchResponse{}
+	for i := 0; i < 600; i++ {
+		response.Responses = append(response.Responses, &messaging.SendResponse{Success: true, MessageID: fmt.Sprintf("projects/p/messages/%d", i)})
+		response.SuccessCount++
+	}
+
+	recordNotification(db, notificationDevices, []string{"a", "b", "a"}, response)
+
+	var notification Notification
+	if err := db.First(&notification).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var messages, events int
+	db.Model(&NotificationMessage{}).Where("notification_id = ?", notification.Id).Count(&messages)
+	db.Model(&NotificationEvent{}).Where("notification_id = ?", notification.Id).Count(&events)
+	if notification.Recipients != 600 || messages != 600 || events != 2 {
+		t.Errorf("expected 600 recipients and messages and 2 events, got %d, %d and %d", notification.Recipients, messages, events)
+	}
+
+	var message NotificationMessage
+	if err := db.Where("message_id = ?", "599").First(&message).Error; err != nil {
+		t.Errorf("message id wasn't shortened: %v", err)
+	}
+}
+
+func TestAcknowledgeNotificationDeduplicates(t *testing.T) {
+	openTestDb(t)
+	if err := MigrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	recordTopicNotification(db, DefaultTopic, []string{"a"}, "projects/p/messages/topic", nil)
+	recordNotification(db, notificationDevices, []string{"a"}, &messaging.BatchResponse{
+		SuccessCount: 1,
+		Responses:    []*messaging.SendResponse{{Success: true, MessageID: "projects/p/messages/device"}},
+	})
+
+	acks := []struct {
+		body   string
+		status int
+	}{
+		{`{"message_id": "topic", "status": "received", "key": "t1"}`, http.StatusOK},
+		{`{"message_id": "topic", "status": "received", "key": "t1"}`, http.StatusOK},
+		{`{"message_id": "topic", "status": "opened", "key": "t1"}`, http.StatusOK},
+		{`{"message_id": "topic", "status": "received", "key": "t2"}`, http.StatusOK},
+		{`{"message_id": "topic", "status": "received"}`, http.StatusBadRequest},
+		{`{"message_id": "projects/p/messages/device", "status": "received"}`, http.StatusOK},
+		{`{"message_id": "device", "status": "received"}`, http.StatusOK},
+		{`{"message_id": "unknown", "status": "received"}`, http.StatusNotFound},
+	}
+
+	for _, ack := range acks {
+		recorder := httptest.NewRecorder()
+		AcknowledgeNotification(recorder, httptest.NewRequest(http.MethodPost, "/ack", strings.NewReader(ack.body)), nil)
+		if recorder.Code != ack.status {
+			t.Errorf("%s: expected status %d, got %d", ack.body, ack.status, recorder.Code)
+		}
+	}
+
+	var stored []NotificationAck
+	if err := db.Order("id").Find(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != 4 || stored[3].Device != "device" {
+		t.Errorf("expected 3 topic acks and 1 device ack, got %+v", stored)
+	}
+}
@@ -0,0 +1,365 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/jinzhu/gorm"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultRouteBufferMeters = 500
+const maxRouteBufferMeters = 5000
+const maxRoutesPerDevice = 10
+
+// Route is a saved commute of a device. Devices with routes only receive events near a route
+// which is active at the time of dispatch.
+type Route struct {
+	Id       int64  `json:"id"`
+	ApiKeyId int64  `json:"-" sql:"index"`
+	Name     string `json:"name"`
+	Polyline string `json:"polyline" sql:"type:text"`
+	// Active window in minutes after midnight in device's timezone, equal values mean always active.
+	ActiveFrom   int `json:"-"`
+	ActiveTo     int `json:"-"`
+	BufferMeters int `json:"buffer"`
+
+	ActiveFromStr string   `json:"active_from" sql:"-"`
+	ActiveToStr   string   `json:"active_to" sql:"-"`
+	points        []LatLng `sql:"-"`
+}
+
+// routeRequest is the body of route create and update requests.
+type routeRequest struct {
+	Key          string `json:"key"`
+	Name         string `json:"name"`
+	Polyline     string `json:"polyline"`
+	ActiveFrom   string `json:"active_from"`
+	ActiveTo     string `json:"active_to"`
+	BufferMeters int    `json:"buffer"`
+}
+
+func formatClockTime(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// apply validates the request and stores its values into the route.
+func (req *routeRequest) apply(route *Route) error {
+	if len(req.Name) == 0 {
+		return fmt.Errorf("route name is required")
+	}
+
+	points, err := decodePolyline(req.Polyline)
+	if err != nil {
+		return fmt.Errorf("invalid polyline: %v", err)
+	}
+
+	if len(points) == 0 {
+		return fmt.Errorf("polyline is empty")
+	}
+
+	route.ActiveFrom, route.ActiveTo = 0, 0
+	if len(req.ActiveFrom) > 0 || len(req.ActiveTo) > 0 {
+		if route.ActiveFrom, err = parseClockTime(req.ActiveFrom); err != nil {
+			return err
+		}
+
+		if route.ActiveTo, err = parseClockTime(req.ActiveTo); err != nil {
+			return err
+		}
+	}
+
+	if req.BufferMeters < 0 || req.BufferMeters > maxRouteBufferMeters {
+		return fmt.Errorf("buffer must be between 0 and %d meters", maxRouteBufferMeters)
+	}
+
+	route.BufferMeters = req.BufferMeters
+	if route.BufferMeters == 0 {
+		route.BufferMeters = defaultRouteBufferMeters
+	}
+
+	route.Name = req.Name
+	route.Polyline = req.Polyline
+	route.points = points
+	return nil
+}
+
+// AfterFind fills in the fields which are only present in JSON.
+func (r *Route) AfterFind() error {
+	r.ActiveFromStr = formatClockTime(r.ActiveFrom)
+	r.ActiveToStr = formatClockTime(r.ActiveTo)
+	return nil
+}
+
+// isActive checks whether the route window includes the passed time in the passed timezone.
+func (r *Route) isActive(now time.Time, loc *time.Location) bool {
+	if r.ActiveFrom == r.ActiveTo {
+		return true
+	}
+
+	local := now.In(loc)
+	minutes := local.Hour()*60 + local.Minute()
+	if r.ActiveFrom < r.ActiveTo {
+		return minutes >= r.ActiveFrom && minutes < r.ActiveTo
+	}
+
+	return minutes >= r.ActiveFrom || minutes < r.ActiveTo
+}
+
+// isNear checks whether the event lies within the buffer around the route.
+func (r *Route) isNear(event *Dogodek) bool {
+	if r.points == nil {
+		points, err := decodePolyline(r.Polyline)
+		if err != nil {
+			log.WithFields(log.Fields{"route": r.Id, "err": err}).Warn("Stored route has invalid polyline.")
+			return false
+		}
+
+		r.points = points
+	}
+
+	return distanceToPolylineMeters(eventPosition(event), r.points) <= float64(r.BufferMeters)
+}
+
+// loadRoutes returns routes of the passed devices, keyed by device id.
+func loadRoutes(tx *gorm.DB, apiKeys []ApiKey) (map[int64][]Route, error) {
+	ids := make([]int64, len(apiKeys))
+	for i, apiKey := range apiKeys {
+		ids[i] = apiKey.Id
+	}
+
+	var routes []Route
+	if err := tx.Where("api_key_id IN (?)", ids).Find(&routes).Error; err != nil {
+		return nil, err
+	}
+
+	result := make(map[int64][]Route)
+	for _, route := range routes {
+		result[route.ApiKeyId] = append(result[route.ApiKeyId], route)
+	}
+
+	return result, nil
+}
+
+// filterEventsByRoutes returns events lying along any of the routes active at the passed time.
+func filterEventsByRoutes(apiKey *ApiKey, routes []Route, events []Dogodek, now time.Time) []Dogodek {
+	loc := apiKey.location()
+	matching := make([]Dogodek, 0, len(events))
+	for i := range events {
+		near := false
+		for j := range routes {
+			if routes[j].isActive(now, loc) && routes[j].isNear(&events[i]) {
+				near = true
+				break
+			}
+		}
+
+		if !near {
+			log.WithFields(log.Fields{"apiKey": apiKey.Key, "id": events[i].Id, "reason": "not on active route"}).Debug("Event filtered out.")
+			continue
+		}
+
+		matching = append(matching, events[i])
+	}
+
+	return matching
+}
+
+func findDeviceByKey(tx *gorm.DB, w http.ResponseWriter, key string) (*ApiKey, bool) {
+	if len(key) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Missing device key."))
+		return nil, false
+	}
+
+	var apiKey ApiKey
+	query := tx.Where("key = ?", key).First(&apiKey)
+	if query.RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Device not registered."))
+		return nil, false
+	}
+
+	if query.Error != nil {
+		sentry.CaptureException(query.Error)
+		log.WithFields(log.Fields{"err": query.Error}).Error("Failed to load device registration.")
+		returnError(w)
+		return nil, false
+	}
+
+	return &apiKey, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header()["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// ListRoutes returns routes saved by the device passed in the key query parameter.
+func ListRoutes(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	db := GetDbConnection()
+	apiKey, ok := findDeviceByKey(db, w, r.URL.Query().Get("key"))
+	if !ok {
+		return
+	}
+
+	routes := make([]Route, 0)
+	if err := db.Where("api_key_id = ?", apiKey.Id).Order("id").Find(&routes).Error; err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"err": err}).Error("Failed to load routes.")
+		returnError(w)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, routes)
+}
+
+// CreateRoute saves a new route for the device.
+func CreateRoute(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req routeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid route."))
+		return
+	}
+
+	db := GetDbConnection()
+	tx := db.Begin()
+	apiKey, ok := findDeviceByKey(tx, w, req.Key)
+	if !ok {
+		tx.Rollback()
+		return
+	}
+
+	var count int
+	if err := tx.Model(&Route{}).Where("api_key_id = ?", apiKey.Id).Count(&count).Error; err != nil {
+		sentry.CaptureException(err)
+		tx.Rollback()
+		returnError(w)
+		return
+	}
+
+	if count >= maxRoutesPerDevice {
+		tx.Rollback()
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Too many routes."))
+		return
+	}
+
+	route := Route{ApiKeyId: apiKey.Id}
+	if err := req.apply(&route); err != nil {
+		tx.Rollback()
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if err := tx.Create(&route).Error; err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"err": err}).Error("Failed to save route.")
+		tx.Rollback()
+		returnError(w)
+		return
+	}
+
+	tx.Commit()
+	route.AfterFind()
+	log.WithFields(log.Fields{"apiKey": apiKey.Key, "route": route.Name}).Info("Route created.")
+	writeJSON(w, http.StatusCreated, route)
+}
+
+// UpdateRoute replaces an existing route of the device.
+func UpdateRoute(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var req routeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid route."))
+		return
+	}
+
+	db := GetDbConnection()
+	tx := db.Begin()
+	route, ok := findRoute(tx, w, req.Key, ps.ByName("id"))
+	if !ok {
+		tx.Rollback()
+		return
+	}
+
+	if err := req.apply(route); err != nil {
+		tx.Rollback()
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if err := tx.Save(route).Error; err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"err": err}).Error("Failed to save route.")
+		tx.Rollback()
+		returnError(w)
+		return
+	}
+
+	tx.Commit()
+	route.AfterFind()
+	writeJSON(w, http.StatusOK, route)
+}
+
+// DeleteRoute removes a route of the device passed in the key query parameter.
+func DeleteRoute(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	db := GetDbConnection()
+	tx := db.Begin()
+	route, ok := findRoute(tx, w, r.URL.Query().Get("key"), ps.ByName("id"))
+	if !ok {
+		tx.Rollback()
+		return
+	}
+
+	if err := tx.Delete(route).Error; err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"err": err}).Error("Failed to delete route.")
+		tx.Rollback()
+		returnError(w)
+		return
+	}
+
+	tx.Commit()
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+func findRoute(tx *gorm.DB, w http.ResponseWriter, key string, idStr string) (*Route, bool) {
+	apiKey, ok := findDeviceByKey(tx, w, key)
+	if !ok {
+		return nil, false
+	}
+
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid route id."))
+		return nil, false
+	}
+
+	var route Route
+	query := tx.Where("id = ? AND api_key_id = ?", id, apiKey.Id).First(&route)
+	if query.RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Route not found."))
+		return nil, false
+	}
+
+	if query.Error != nil {
+		sentry.CaptureException(query.Error)
+		returnError(w)
+		return nil, false
+	}
+
+	return &route, true
+}
@@ -0,0 +1,58 @@
+package src
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRouteIsActive(t *testing.T) {
+	ljubljana, err := time.LoadLocation("Europe/Ljubljana")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 05:30 UTC is 07:30 in Ljubljana during summer time.
+	now := time.Date(2026, 7, 1, 5, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		route    Route
+		loc      *time.Location
+		expected bool
+	}{
+		{"always active", Route{}, ljubljana, true},
+		{"inside window", Route{ActiveFrom: 7 * 60, ActiveTo: 9 * 60}, ljubljana, true},
+		{"window in server time", Route{ActiveFrom: 7 * 60, ActiveTo: 9 * 60}, time.UTC, false},
+		{"window end is excluded", Route{ActiveFrom: 6 * 60, ActiveTo: 7*60 + 30}, ljubljana, false},
+		{"wrapping past midnight", Route{ActiveFrom: 22 * 60, ActiveTo: 8 * 60}, ljubljana, true},
+		{"outside wrapping window", Route{ActiveFrom: 22 * 60, ActiveTo: 6 * 60}, ljubljana, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := test.route.isActive(now, test.loc); actual != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestFilterEventsByRoutes(t *testing.T) {
+	now := time.Date(2026, 7, 1, 5, 30, 0, 0, time.UTC)
+	key := ApiKey{Key: "key", Timezone: "Europe/Ljubljana"}
+	routes := []Route{
+		{Polyline: "_p~iF~ps|U_ulLnnqC", BufferMeters: 500},
+		// Inactive at the time, so the event near it is dropped.
+		{Polyline: "_kbvD_wfhA", BufferMeters: 500, ActiveFrom: 18 * 60, ActiveTo: 20 * 60},
+	}
+
+	events := []Dogodek{
+		{Id: "near", Y_wgs: 38.5, X_wgs: -120.2},
+		{Id: "inactive", Y_wgs: 30, X_wgs: 12},
+		{Id: "far", Y_wgs: 46, X_wgs: 14.5},
+	}
+
+	matching := filterEventsByRoutes(&key, routes, events, now)
+	if len(matching) != 1 || matching[0].Id != "near" {
+		t.Errorf("expected only the event near the active route, got %+v", matching)
+	}
+}
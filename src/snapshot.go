@@ -0,0 +1,167 @@
+package src
+
+import (
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+)
+
+// FeedStatus records when a feed was last retrieved successfully, so the age of restored data is known.
+type FeedStatus struct {
+	Id          string
+	FetchedTime int64
+}
+
+// DataAge holds unix times at which served data was retrieved from upstream.
+type DataAge struct {
+	Events  int64 `json:"events"`
+	Cameras int64 `json:"cameras"`
+	Prices  int64 `json:"prices"`
+}
+
+// servedData is the data served to clients. Slices are shared with requests being served, so they're
+// replaced instead of modified.
+type servedData struct {
+	// Events as received, served events are built from them again when cameras change.
+	received []Dogodek
+	events   []JsonEvent
+	// Maps ids of events served to clients to upstream ids.
+	eventIds map[int64]string
+	cameras  []Camera
+	prices   []GasStationPrice
+	age      DataAge
+	// Set while served data is the one restored from the database and not yet retrieved since the start.
+	restoredEvents, restoredCameras, restoredPrices bool
+}
+
+var served servedData
+var servedLock sync.RWMutex
+
+// currentData returns a snapshot of the served data.
+func currentData() servedData {
+	servedLock.RLock()
+	defer servedLock.RUnlock()
+	return served
+}
+
+// updateData changes the served data, other readers and writers wait until update returns.
+func updateData(update func(data *servedData)) {
+	servedLock.Lock()
+	defer servedLock.Unlock()
+	update(&served)
+}
+
+func recordFetch(db *gorm.DB, feed string, fetched time.Time) {
+	if err := db.Save(&FeedStatus{feed, fetched.Unix()}).Error; err != nil {
+		log.WithFields(log.Fields{"err": err, "feed": feed}).Error("Failed to record feed fetch.")
+		sentry.CaptureException(err)
+	}
+}
+
+// lastFetch returns the time of the last successful fetch of the feed or a zero time.
+func lastFetch(db *gorm.DB, feed string) (time.Time, error) {
+	var status FeedStatus
+	err := db.Where("id = ?", feed).First(&status).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(status.FetchedTime, 0), nil
+}
+
+// loadValidEvents returns stored events which are still in the feed and valid.
+func loadValidEvents(db *gorm.DB, now time.Time) ([]Dogodek, error) {
+	var events []Dogodek
+	err := db.Where("active = ? AND veljavnost_do > ?", true, now.Unix()).Order("updated").Find(&events).Error
+	return events, err
+}
+
+// loadFuelPrices returns current prices of stations included in the fetch at time fetched.
+func loadFuelPrices(db *gorm.DB, fetched time.Time) ([]GasStationPrice, error) {
+	stations, err := fetchedFuelStations(db, fetched)
+	if err != nil {
+		return nil, err
+	}
+
+	latest, err := latestFuelPrices(db, "")
+	if err != nil {
+		return nil, err
+	}
+
+	pricesByStation := make(map[string][]GasPrice)
+	for _, price := range latest {
+		pricesByStation[price.StationId] = append(pricesByStation[price.StationId], GasPrice{price.FuelType, price.Price})
+	}
+
+	prices := make([]GasStationPrice, len(stations))
+	for i, station := range stations {
+		prices[i] = GasStationPrice{station.Id, station.Name, station.Address, station.X_wgs, station.Y_wgs, pricesByStation[station.Id]}
+	}
+
+	return prices, nil
+}
+
+// restoreSnapshot serves data stored by the last successful fetches until fresh data is retrieved, so
+// clients get data right after a restart even when upstream is unavailable.
+func restoreSnapshot(db *gorm.DB) error {
+	now := time.Now()
+	// Cameras go first, they are attached to events.
+	if fetched, err := lastFetch(db, "cameras"); err != nil {
+		return err
+	} else if !fetched.IsZero() {
+		cameras, err := loadCameras(db)
+		if err != nil {
+			return err
+		}
+
+		updateData(func(data *servedData) {
+			data.cameras = cameras
+			data.age.Cameras = fetched.Unix()
+			data.restoredCameras = true
+		})
+		log.WithFields(log.Fields{"num": len(cameras), "fetched": fetched}).Info("Restored stored cameras.")
+	}
+
+	if fetched, err := lastFetch(db, "events"); err != nil {
+		return err
+	} else if !fetched.IsZero() {
+		events, err := loadValidEvents(db, now)
+		if err != nil {
+			return err
+		}
+
+		updateData(func(data *servedData) {
+			data.received = events
+			data.events, data.eventIds = toJsonEvents(events, data.cameras)
+			data.age.Events = fetched.Unix()
+			data.restoredEvents = true
+		})
+		log.WithFields(log.Fields{"num": len(events), "fetched": fetched}).Info("Restored stored events.")
+	}
+
+	if fetched, err := lastFetch(db, "fuel-prices"); err != nil {
+		return err
+	} else if !fetched.IsZero() {
+		prices, err := loadFuelPrices(db, fetched)
+		if err != nil {
+			return err
+		}
+
+		updateData(func(data *servedData) {
+			data.prices = prices
+			data.age.Prices = fetched.Unix()
+			data.restoredPrices = true
+		})
+		fuelPricesLock.Lock()
+		fuelPricesUpdated = fetched
+		fuelPricesLock.Unlock()
+		log.WithFields(log.Fields{"num": len(prices), "fetched": fetched}).Info("Restored stored fuel prices.")
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package src
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestoreSnapshot(t *testing.T) {
+	openTestDb(t)
+	if err := MigrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	updateData(func(data *servedData) { *data = servedData{} })
+	defer updateData(func(data *servedData) { *data = servedData{} })
+
+	// Nothing is restored before the first fetch.
+	if err := restoreSnapshot(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if data := currentData(); data.restoredEvents || data.restoredCameras || data.restoredPrices {
+		t.Fatalf("restored data without fetches, got %+v", data)
+	}
+
+	now := time.Now()
+	fetched := now.Add(-time.Hour).Truncate(time.Second)
+	valid := uint64(now.Add(time.Hour).Unix())
+	events := []Dogodek{
+		{Id: "a", Vzrok: "Nesreča", Y_wgs: 46.05, X_wgs: 14.5, VeljavnostDo: valid},
+		{Id: "b", Vzrok: "Zastoj", Y_wgs: 46.23, X_wgs: 15.26, VeljavnostDo: valid},
+		{Id: "expired", Vzrok: "Zastoj", Y_wgs: 46.23, X_wgs: 15.26, VeljavnostDo: uint64(now.Add(-time.Minute).Unix())},
+	}
+
+	if _, err := storeEvents(db, events, nil, fetched); err != nil {
+		t.Fatal(err)
+	}
+
+	// Events which left the feed aren't restored.
+	if _, err := storeEvents(db, events[:1], nil, fetched); err != nil {
+		t.Fatal(err)
+	}
+
+	cameras := []Camera{{Id: cameraId("l", 0), LocationId: "l", ImageURL: "https://example.com/l.jpg", Y_wgs: 46.05, X_wgs: 14.5}}
+	if _, err := storeCameras(db, cameras, fetched); err != nil {
+		t.Fatal(err)
+	}
+
+	recordFetch(db, "events", fetched)
+	recordFetch(db, "cameras", fetched)
+	if err := restoreSnapshot(db); err != nil {
+		t.Fatal(err)
+	}
+
+	data := currentData()
+	if !data.restoredEvents || !data.restoredCameras || data.restoredPrices {
+		t.Errorf("unexpected restored feeds %v, %v and %v", data.restoredEvents, data.restoredCameras, data.restoredPrices)
+	}
+
+	if len(data.received) != 1 || data.received[0].Id != "a" || len(data.events) != 1 || len(data.eventIds) != 1 {
+		t.Errorf("expected only the active event, got %+v", data.received)
+	}
+
+	if len(data.cameras) != 1 || data.cameras[0].Id != cameras[0].Id {
+		t.Errorf("unexpected cameras %+v", data.cameras)
+	}
+
+	if data.age.Events != fetched.Unix() || data.age.Cameras != fetched.Unix() || data.age.Prices != 0 {
+		t.Errorf("unexpected age %+v", data.age)
+	}
+}
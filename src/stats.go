@@ -1,28 +1,74 @@
 package src
 
 import (
+	"database/sql"
 	"fmt"
+	"io"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/getsentry/sentry-go"
+	"github.com/jinzhu/gorm"
 	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
 )
 
+// Statistics are counted per day in this timezone.
+const statsTimezone = "Europe/Ljubljana"
+
+const defaultHistoryDays = 30
+
+// Statistics are counters of a single day. They're kept in memory and periodically saved to the database.
 type Statistics struct {
-	Dispatches       int
-	FailedDispatches int
-	FailedMessages   int
-	UpdatedPushKeys  int
+	// Date in statsTimezone, formatted as YYYY-MM-DD.
+	Day string `json:"day" sql:"primary_key"`
 
-	DeviceRegistrations          int
-	DeviceUnregistrations        int
-	DeviceUnregistrationsInvalid int
+	Dispatches       int `json:"dispatches"`
+	FailedDispatches int `json:"failed_dispatches"`
+	FailedMessages   int `json:"failed_messages"`
+	UpdatedPushKeys  int `json:"updated_push_keys"`
+	SuppressedPushes int `json:"suppressed_pushes"`
+	DigestDispatches int `json:"digest_dispatches"`
+	InsertedEvents   int `json:"inserted_events"`
+	UpdatedEvents    int `json:"updated_events"`
+	SkippedEvents    int `json:"skipped_events" sql:"default:0"`
+	QuarantinedItems int `json:"quarantined_items"`
+	AnomalousFetches int `json:"anomalous_fetches"`
+	AddedCameras     int `json:"added_cameras"`
+	RemovedCameras   int `json:"removed_cameras"`
+	ChangedCameras   int `json:"changed_cameras"`
+	CameraOutages    int `json:"camera_outages"`
 
-	Created time.Time
+	DeviceRegistrations          int `json:"device_registrations"`
+	DeviceUnregistrations        int `json:"device_unregistrations"`
+	DeviceUnregistrationsInvalid int `json:"device_unregistrations_invalid"`
 }
 
 var stats Statistics
+var statsLock sync.Mutex
+var statsLocation = loadStatsLocation()
+
+func loadStatsLocation() *time.Location {
+	location, err := time.LoadLocation(statsTimezone)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err, "timezone": statsTimezone}).Warn("Timezone not available, statistics use local time.")
+		return time.Local
+	}
+
+	return location
+}
+
+// statsDay returns the day statistics at time t are counted in.
+func statsDay(t time.Time) string {
+	return t.In(statsLocation).Format("2006-01-02")
+}
+
+// statsDayStart returns the start of the day t is in.
+func statsDayStart(t time.Time) time.Time {
+	t = t.In(statsLocation)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, statsLocation)
+}
 
 func ShowStatistics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	r.Close = true
@@ -42,18 +88,50 @@ func ShowStatistics(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 
 	// Find todays events
 	timeNow := time.Now()
-	timeToday := time.Date(timeNow.Year(), timeNow.Month(), timeNow.Day(),
-		0, 0, 0, 0, timeNow.Location())
+	timeToday := statsDayStart(timeNow).Unix()
 
-	err = tx.Where("vneseno > ?", timeToday.Unix()/1000).Model(&Dogodek{}).Count(&count)
+	err = tx.Where("vneseno >= ?", timeToday).Model(&Dogodek{}).Count(&count)
 	if err.Error != nil {
 		log.WithFields(log.Fields{"err": err.Error}).Error("Failed to retrieve statistics.")
 		count = -1
 	}
 
 	fmt.Fprintf(w, "todays_events:%d\n", count)
+	writeEventCounts(w, tx, "todays_events_category", "kategorija", timeToday)
+	writeEventCounts(w, tx, "todays_events_road", "cesta", timeToday)
+
+	// Only events with a known end have a duration.
+	var duration sql.NullFloat64
+	row := tx.Model(&Dogodek{}).Select("AVG(veljavnost_do - veljavnost_od)").
+		Where("vneseno >= ? AND veljavnost_od > 0 AND veljavnost_do > veljavnost_od", timeToday).Row()
+	if err := row.Scan(&duration); err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Failed to retrieve statistics.")
+		duration = sql.NullFloat64{Float64: -1, Valid: true}
+	}
+
+	fmt.Fprintf(w, "todays_average_event_duration:%d\n", int64(duration.Float64))
+
+	err = tx.Where("active = ?", true).Model(&Dogodek{}).Count(&count)
+	if err.Error != nil {
+		log.WithFields(log.Fields{"err": err.Error}).Error("Failed to retrieve statistics.")
+		count = -1
+	}
+
+	fmt.Fprintf(w, "active_events:%d\n", count)
+
+	offline := 0
+	cameras := currentData().cameras
+	for _, camera := range cameras {
+		if camera.Offline {
+			offline++
+		}
+	}
+
+	fmt.Fprintf(w, "cameras:%d\n", len(cameras))
+	fmt.Fprintf(w, "offline_cameras:%d\n", offline)
+
+	statistics := currentStatistics(time.Now(), nil)
 
-	statistics := GetStatistics()
 	fmt.Fprintf(w, "today_dispatches:%d\n", statistics.Dispatches)
 	fmt.Fprintf(w, "today_failed_dispatches:%d\n", statistics.FailedDispatches)
 	fmt.Fprintf(w, "today_device_registrations:%d\n", statistics.DeviceRegistrations)
@@ -61,14 +139,153 @@ func ShowStatistics(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 	fmt.Fprintf(w, "today_device_unregistrations_invalid:%d\n", statistics.DeviceUnregistrationsInvalid)
 	fmt.Fprintf(w, "today_device_updatedkeys:%d\n", statistics.UpdatedPushKeys)
 	fmt.Fprintf(w, "today_failed_messages:%d\n", statistics.FailedMessages)
+	fmt.Fprintf(w, "today_suppressed_pushes:%d\n", statistics.SuppressedPushes)
+	fmt.Fprintf(w, "today_digest_dispatches:%d\n", statistics.DigestDispatches)
+	fmt.Fprintf(w, "today_inserted_events:%d\n", statistics.InsertedEvents)
+	fmt.Fprintf(w, "today_updated_events:%d\n", statistics.UpdatedEvents)
+	fmt.Fprintf(w, "today_skipped_events:%d\n", statistics.SkippedEvents)
+	fmt.Fprintf(w, "today_quarantined_items:%d\n", statistics.QuarantinedItems)
+	fmt.Fprintf(w, "today_anomalous_fetches:%d\n", statistics.AnomalousFetches)
+	fmt.Fprintf(w, "today_added_cameras:%d\n", statistics.AddedCameras)
+	fmt.Fprintf(w, "today_removed_cameras:%d\n", statistics.RemovedCameras)
+	fmt.Fprintf(w, "today_changed_cameras:%d\n", statistics.ChangedCameras)
+	fmt.Fprintf(w, "today_camera_outages:%d\n", statistics.CameraOutages)
 }
 
-func GetStatistics() *Statistics {
-	timeNow := time.Now()
-	if timeNow.Day() != stats.Created.Day() || timeNow.Month() != stats.Created.Month() {
-		stats = Statistics{}
-		stats.Created = timeNow
+// writeEventCounts writes the number of events received since the time for each value of the column.
+func writeEventCounts(w io.Writer, tx *gorm.DB, name string, column string, since int64) {
+	rows, err := tx.Model(&Dogodek{}).Select(column+", COUNT(*)").Where("vneseno >= ?", since).
+		Group(column).Order(column).Rows()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Failed to retrieve statistics.")
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var value string
+		var count int
+		if err := rows.Scan(&value, &count); err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("Failed to retrieve statistics.")
+			return
+		}
+
+		fmt.Fprintf(w, "%s[%s]:%d\n", name, value, count)
+	}
+}
+
+// UpdateStatistics applies the update to today's statistics. It's safe to call from multiple goroutines.
+func UpdateStatistics(update func(s *Statistics)) {
+	currentStatistics(time.Now(), update)
+}
+
+// currentStatistics applies the update to statistics of the day now is in and returns their copy. When the day
+// changed, statistics of the previous day are saved after statsLock is released, so counting doesn't wait for
+// the database.
+func currentStatistics(now time.Time, update func(s *Statistics)) Statistics {
+	current, previous := rollStatistics(now, update)
+	if previous != nil {
+		saveStatistics(*previous)
+	}
+
+	return current
+}
+
+// rollStatistics starts counting a new day when now is past the current one and applies the update. Returns the
+// updated statistics and statistics of the previous day when the day changed.
+func rollStatistics(now time.Time, update func(s *Statistics)) (Statistics, *Statistics) {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	var previous *Statistics
+	if day := statsDay(now); stats.Day != day {
+		if len(stats.Day) > 0 {
+			old := stats
+			previous = &old
+		}
+
+		stats = Statistics{Day: day}
+	}
+
+	if update != nil {
+		update(&stats)
+	}
+
+	return stats, previous
+}
+
+func saveStatistics(statistics Statistics) {
+	if err := GetDbConnection().Save(&statistics).Error; err != nil {
+		log.WithFields(log.Fields{"err": err, "day": statistics.Day}).Error("Failed to save statistics.")
+		sentry.CaptureException(err)
+	}
+}
+
+// SaveStatistics stores today's statistics in the database.
+func SaveStatistics() {
+	saveStatistics(currentStatistics(time.Now(), nil))
+}
+
+// LoadStatistics continues counting from today's statistics saved before a restart.
+func LoadStatistics() error {
+	var saved Statistics
+	err := GetDbConnection().Where("day = ?", statsDay(time.Now())).First(&saved).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	stats = saved
+	return nil
+}
+
+// ShowStatisticsHistory returns daily statistics between the from and to query parameters, formatted as
+// YYYY-MM-DD. Last 30 days are returned by default.
+func ShowStatisticsHistory(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	today := statsDayStart(time.Now())
+	to, from := today, today.AddDate(0, 0, -defaultHistoryDays+1)
+	var err error
+	if value := r.URL.Query().Get("to"); len(value) > 0 {
+		if to, err = time.ParseInLocation("2006-01-02", value, statsLocation); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid to, expected YYYY-MM-DD."))
+			return
+		}
+
+		from = to.AddDate(0, 0, -defaultHistoryDays+1)
+	}
+
+	if value := r.URL.Query().Get("from"); len(value) > 0 {
+		if from, err = time.ParseInLocation("2006-01-02", value, statsLocation); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid from, expected YYYY-MM-DD."))
+			return
+		}
+	}
+
+	// Days are formatted so that they sort by date.
+	history := make([]Statistics, 0)
+	err = GetDbConnection().Where("day BETWEEN ? AND ?", from.Format("2006-01-02"), to.Format("2006-01-02")).
+		Order("day").Find(&history).Error
+	if err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"err": err}).Error("Failed to load statistics history.")
+		returnError(w)
+		return
+	}
+
+	// Today's saved statistics lag behind the ones in memory.
+	current := currentStatistics(time.Now(), nil)
+	if current.Day >= from.Format("2006-01-02") && current.Day <= to.Format("2006-01-02") {
+		if len(history) > 0 && history[len(history)-1].Day == current.Day {
+			history[len(history)-1] = current
+		} else {
+			history = append(history, current)
+		}
 	}
 
-	return &stats
+	writeJSON(w, http.StatusOK, history)
 }
@@ -0,0 +1,107 @@
+package src
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatsDay(t *testing.T) {
+	tests := []struct {
+		time  time.Time
+		day   string
+		start time.Time
+	}{
+		// Ljubljana is two hours ahead of UTC in summer and one in winter.
+		{time.Date(2026, 10, 18, 21, 59, 0, 0, time.UTC), "2026-10-18", time.Date(2026, 10, 17, 22, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 18, 22, 0, 0, 0, time.UTC), "2026-10-19", time.Date(2026, 10, 18, 22, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 12, 31, 22, 59, 0, 0, time.UTC), "2026-12-31", time.Date(2026, 12, 30, 23, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 12, 31, 23, 0, 0, 0, time.UTC), "2027-01-01", time.Date(2026, 12, 31, 23, 0, 0, 0, time.UTC)},
+		// The day summer time ends is 25 hours long.
+		{time.Date(2026, 10, 25, 22, 30, 0, 0, time.UTC), "2026-10-25", time.Date(2026, 10, 24, 22, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		if day := statsDay(test.time); day != test.day {
+			t.Errorf("%v: expected day %s, got %s", test.time, test.day, day)
+		}
+
+		if start := statsDayStart(test.time); !start.Equal(test.start) {
+			t.Errorf("%v: expected day start %v, got %v", test.time, test.start, start.UTC())
+		}
+	}
+}
+
+func resetStatistics() {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	stats = Statistics{}
+}
+
+func TestStatisticsRollover(t *testing.T) {
+	openTestDb(t)
+	if err := MigrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	resetStatistics()
+	defer resetStatistics()
+
+	beforeMidnight := time.Date(2026, 10, 18, 21, 30, 0, 0, time.UTC)
+	currentStatistics(beforeMidnight, func(s *Statistics) { s.Dispatches += 2 })
+	current := currentStatistics(beforeMidnight.Add(time.Hour), func(s *Statistics) { s.Dispatches++ })
+	if current.Day != "2026-10-19" || current.Dispatches != 1 {
+		t.Errorf("new day didn't start counting from zero, got %+v", current)
+	}
+
+	var saved Statistics
+	if err := db.Where("day = ?", "2026-10-18").First(&saved).Error; err != nil || saved.Dispatches != 2 {
+		t.Errorf("previous day wasn't saved, got %+v, err %v", saved, err)
+	}
+}
+
+func TestShowStatisticsHistory(t *testing.T) {
+	openTestDb(t)
+	if err := MigrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	statsLock.Lock()
+	stats = Statistics{Day: statsDay(now), Dispatches: 5}
+	statsLock.Unlock()
+	defer resetStatistics()
+
+	yesterday := statsDay(statsDayStart(now).Add(-time.Hour))
+	for _, saved := range []Statistics{{Day: "2020-01-01", Dispatches: 1}, {Day: yesterday, Dispatches: 2}, {Day: statsDay(now), Dispatches: 3}} {
+		saveStatistics(saved)
+	}
+
+	request := func(query string) (int, []Statistics) {
+		recorder := httptest.NewRecorder()
+		ShowStatisticsHistory(recorder, httptest.NewRequest(http.MethodGet, "/stats/history"+query, nil), nil)
+		var history []Statistics
+		if recorder.Code == http.StatusOK {
+			if err := json.NewDecoder(recorder.Body).Decode(&history); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return recorder.Code, history
+	}
+
+	// Today's statistics in memory replace the saved ones.
+	if code, history := request(""); code != http.StatusOK || len(history) != 2 || history[0].Dispatches != 2 || history[1].Dispatches != 5 {
+		t.Errorf("unexpected default history %d %+v", code, history)
+	}
+
+	if code, history := request("?from=2019-12-31&to=2020-01-02"); code != http.StatusOK || len(history) != 1 || history[0].Day != "2020-01-01" {
+		t.Errorf("unexpected history %d %+v", code, history)
+	}
+
+	if code, _ := request("?to=01.01.2020"); code != http.StatusBadRequest {
+		t.Errorf("invalid date accepted, got %d", code)
+	}
+}
@@ -0,0 +1,104 @@
+package src
+
+import (
+	"context"
+	"time"
+
+	"firebase.google.com/go/messaging"
+	"github.com/getsentry/sentry-go"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+)
+
+// SendTestPush sends a sample event to a single device and returns the FCM message id.
+func SendTestPush(ctx context.Context, client *messaging.Client, token string) (string, error) {
+	now := time.Now()
+	events := []PushEvent{{
+		Id:            0,
+		Cause:         "Testno obvestilo",
+		CauseEn:       "Test notification",
+		Road:          "Testna cesta",
+		RoadEn:        "Test road",
+		Description:   "To je testno obvestilo.",
+		DescriptionEn: "This is a test notification.",
+		Time:          uint64(now.Unix()) * 1000,
+		Valid:         uint64(now.Add(time.Hour).Unix()) * 1000,
+	}}
+
+	payload, err := encodeEvents(events)
+	if err != nil {
+		return "", err
+	}
+
+	message := &messaging.Message{
+		Data: map[string]string{
+			"events": payload,
+			"test":   "true",
+		},
+		Token: token,
+	}
+
+	message.Android, message.APNS, message.Webpush = platformConfigs(events, message.Data, now)
+	if GetConfiguration().Push.DryRun {
+		return client.SendDryRun(ctx, message)
+	}
+
+	return client.Send(ctx, message)
+}
+
+// ListApiKeys returns all registered devices ordered by registration.
+func ListApiKeys(db *gorm.DB) ([]ApiKey, error) {
+	var keys []ApiKey
+	err := db.Order("id").Find(&keys).Error
+	return keys, err
+}
+
+// PruneApiKeys validates all registered tokens with a dry run send and removes the ones FCM doesn't know anymore.
+// Returns the number of removed registrations.
+func PruneApiKeys(ctx context.Context, db *gorm.DB, client *messaging.Client) (int, error) {
+	removed := 0
+	var lastId int64
+	for {
+		var keys []ApiKey
+		if err := db.Where("id > ?", lastId).Order("id").Limit(pageSize).Find(&keys).Error; err != nil {
+			return removed, err
+		}
+
+		if len(keys) == 0 {
+			return removed, nil
+		}
+
+		lastId = keys[len(keys)-1].Id
+		tokens := make([]string, len(keys))
+		for i, key := range keys {
+			tokens[i] = key.Key
+		}
+
+		response, err := client.SendMulticastDryRun(ctx, &messaging.MulticastMessage{
+			Data:   map[string]string{"test": "true"},
+			Tokens: tokens,
+		})
+
+		if err != nil {
+			return removed, err
+		}
+
+		for i, single := range response.Responses {
+			if single.Success || !messaging.IsRegistrationTokenNotRegistered(single.Error) {
+				continue
+			}
+
+			log.WithField("apiKey", tokens[i]).Info("Removing not registered push key.")
+			err := db.Transaction(func(tx *gorm.DB) error {
+				return deleteApiKey(tx, tokens[i])
+			})
+
+			if err != nil {
+				sentry.CaptureException(err)
+				return removed, err
+			}
+
+			removed++
+		}
+	}
+}
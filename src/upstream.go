@@ -0,0 +1,269 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const upstreamUserAgent = "PrometPush (+https://github.com/izacus/PrometPush)"
+
+// How much of an invalid response body is attached to Sentry reports.
+const maxCapturedBody = 4096
+
+var errCircuitOpen = errors.New("upstream circuit breaker is open")
+var errResponseTooLarge = errors.New("upstream response is too large")
+
+// upstreamStatusError is returned for responses with unexpected status codes.
+type upstreamStatusError struct {
+	Status string
+	Code   int
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream responded with %s", e.Status)
+}
+
+// upstreamResponse is a fully read upstream response.
+type upstreamResponse struct {
+	Url    string
+	Status string
+	Body   []byte
+	// NotModified is set when the server confirmed the body received last time is still current.
+	// Body then holds the last body passed to remember.
+	NotModified bool
+
+	etag         string
+	lastModified string
+}
+
+// cachedResponse keeps validators for conditional requests with the body they belong to.
+type cachedResponse struct {
+	etag         string
+	lastModified string
+	body         []byte
+}
+
+// circuitBreaker stops requests to an upstream after repeated failures for a cooldown period.
+type circuitBreaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+type upstreamClient struct {
+	client *http.Client
+
+	lock     sync.Mutex
+	cache    map[string]cachedResponse
+	breakers map[string]*circuitBreaker
+}
+
+var upstream = newUpstreamClient()
+
+func newUpstreamClient() *upstreamClient {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   4,
+	}
+
+	return &upstreamClient{
+		client:   &http.Client{Transport: transport},
+		cache:    make(map[string]cachedResponse),
+		breakers: make(map[string]*circuitBreaker),
+	}
+}
+
+// fetch retrieves url with retries. name identifies the upstream for the circuit breaker and logs.
+func (u *upstreamClient) fetch(ctx context.Context, name string, url string) (*upstreamResponse, error) {
+	config := GetConfiguration().Upstream
+	if !u.allow(name) {
+		return nil, errCircuitOpen
+	}
+
+	var response *upstreamResponse
+	var err error
+	for attempt := 0; attempt <= config.RetryCount; attempt++ {
+		if attempt > 0 {
+			// Exponential backoff with full jitter.
+			delay := time.Duration(rand.Int63n(int64(config.RetryDelay.Duration) << uint(attempt-1)))
+			log.WithFields(log.Fields{"upstream": name, "err": err, "attempt": attempt, "delay": delay}).Warn("Retrying upstream request.")
+			if !sleepContext(ctx, delay) {
+				break
+			}
+		}
+
+		response, err = u.fetchOnce(ctx, url)
+		if err == nil || !retryableUpstreamError(err) {
+			break
+		}
+	}
+
+	u.record(name, err)
+	if err != nil {
+		log.WithFields(log.Fields{"upstream": name, "url": url, "err": err}).Error("Failed to retrieve data from server.")
+		sentry.CaptureException(err)
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func (u *upstreamClient) fetchOnce(ctx context.Context, url string) (*upstreamResponse, error) {
+	config := GetConfiguration().Upstream
+	ctx, cancel := context.WithTimeout(ctx, config.Timeout.Duration)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("User-Agent", upstreamUserAgent)
+	u.lock.Lock()
+	cached, hasCached := u.cache[url]
+	u.lock.Unlock()
+	if hasCached {
+		if len(cached.etag) > 0 {
+			request.Header.Set("If-None-Match", cached.etag)
+		}
+
+		if len(cached.lastModified) > 0 {
+			request.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	response, err := u.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified && hasCached {
+		io.Copy(ioutil.Discard, io.LimitReader(response.Body, config.MaxBodySize))
+		return &upstreamResponse{url, response.Status, cached.body, true, cached.etag, cached.lastModified}, nil
+	}
+
+	if response.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(response.Body, config.MaxBodySize))
+		return nil, &upstreamStatusError{response.Status, response.StatusCode}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, config.MaxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(body)) > config.MaxBodySize {
+		return nil, errResponseTooLarge
+	}
+
+	return &upstreamResponse{url, response.Status, body, false, response.Header.Get("ETag"), response.Header.Get("Last-Modified")}, nil
+}
+
+// retryableUpstreamError returns true for network errors and server side failures.
+func retryableUpstreamError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, errResponseTooLarge) {
+		return false
+	}
+
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= 500 || statusErr.Code == http.StatusTooManyRequests
+	}
+
+	return true
+}
+
+// remember stores validators of a successfully processed response, so the next request for the same url
+// can be answered with 304 Not Modified. Responses which couldn't be processed must not be remembered.
+func (u *upstreamClient) remember(response *upstreamResponse) {
+	if len(response.etag) == 0 && len(response.lastModified) == 0 {
+		return
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.cache[response.Url] = cachedResponse{response.etag, response.lastModified, response.Body}
+}
+
+// forget drops validators of url, so the next request retrieves the full body again.
+func (u *upstreamClient) forget(url string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	delete(u.cache, url)
+}
+
+func (u *upstreamClient) allow(name string) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	breaker, ok := u.breakers[name]
+	if !ok || time.Now().After(breaker.openUntil) {
+		return true
+	}
+
+	log.WithFields(log.Fields{"upstream": name, "until": breaker.openUntil}).Warn("Upstream circuit breaker is open, skipping request.")
+	return false
+}
+
+// record counts consecutive failures of the upstream and opens its circuit breaker when they reach the threshold.
+func (u *upstreamClient) record(name string, err error) {
+	config := GetConfiguration().Upstream
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	breaker, ok := u.breakers[name]
+	if !ok {
+		breaker = &circuitBreaker{}
+		u.breakers[name] = breaker
+	}
+
+	if err == nil {
+		breaker.failures = 0
+		return
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	breaker.failures++
+	if breaker.failures >= config.BreakerThreshold {
+		breaker.openUntil = time.Now().Add(config.BreakerCooldown.Duration)
+		breaker.failures = 0
+		log.WithFields(log.Fields{"upstream": name, "until": breaker.openUntil}).Error("Opening upstream circuit breaker.")
+	}
+}
+
+// reportInvalidResponse sends the beginning of a response body which couldn't be processed to Sentry.
+func reportInvalidResponse(response *upstreamResponse, err error) {
+	body := response.Body
+	if len(body) > maxCapturedBody {
+		body = body[:maxCapturedBody]
+	}
+
+	sentry.AddBreadcrumb(&sentry.Breadcrumb{
+		Category: "upstream-api",
+		Message:  string(body),
+		Data:     map[string]interface{}{"url": response.Url, "status": response.Status},
+		Level:    "error",
+	})
+
+	sentry.CaptureException(err)
+	log.WithFields(log.Fields{"url": response.Url, "err": err}).Error("Invalid response from server!")
+}
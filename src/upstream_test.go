@@ -0,0 +1,157 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func setUpstreamTestConfig() {
+	cfg := DefaultConfig()
+	cfg.Upstream.RetryCount = 2
+	cfg.Upstream.RetryDelay = Duration{time.Millisecond}
+	cfg.Upstream.BreakerThreshold = 2
+	cfg.Upstream.BreakerCooldown = Duration{time.Hour}
+	cfg.Upstream.MaxBodySize = 16
+	SetConfiguration(cfg)
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	setUpstreamTestConfig()
+	tests := []struct {
+		name     string
+		statuses []int
+		requests int32
+		fails    bool
+	}{
+		{"success", []int{200}, 1, false},
+		{"server error is retried", []int{503, 500, 200}, 3, false},
+		{"too many requests is retried", []int{429, 200}, 2, false},
+		{"retries run out", []int{500, 500, 500, 200}, 3, true},
+		{"client error isn't retried", []int{404, 200}, 1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&requests, 1)
+				w.WriteHeader(test.statuses[n-1])
+				w.Write([]byte("body"))
+			}))
+			defer server.Close()
+
+			response, err := newUpstreamClient().fetch(context.Background(), "test", server.URL)
+			if test.fails != (err != nil) {
+				t.Errorf("expected failure %v, got %v", test.fails, err)
+			}
+
+			if !test.fails && string(response.Body) != "body" {
+				t.Errorf("unexpected body %q", response.Body)
+			}
+
+			if requests != test.requests {
+				t.Errorf("expected %d requests, got %d", test.requests, requests)
+			}
+		})
+	}
+}
+
+func TestUpstreamBodyLimit(t *testing.T) {
+	setUpstreamTestConfig()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("a body longer than the limit"))
+	}))
+	defer server.Close()
+
+	if _, err := newUpstreamClient().fetch(context.Background(), "test", server.URL); !errors.Is(err, errResponseTooLarge) {
+		t.Errorf("expected a too large response, got %v", err)
+	}
+
+	if requests != 1 {
+		t.Errorf("too large response was retried %d times", requests-1)
+	}
+}
+
+func TestUpstreamCircuitBreaker(t *testing.T) {
+	setUpstreamTestConfig()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client := newUpstreamClient()
+	for i := 0; i < 2; i++ {
+		if _, err := client.fetch(context.Background(), "test", server.URL); err == nil {
+			t.Fatal("failing upstream succeeded")
+		}
+	}
+
+	if requests != 6 {
+		t.Fatalf("expected 6 requests, got %d", requests)
+	}
+
+	if _, err := client.fetch(context.Background(), "test", server.URL); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("expected an open circuit, got %v", err)
+	}
+
+	if _, err := client.fetch(context.Background(), "other", server.URL); errors.Is(err, errCircuitOpen) {
+		t.Error("circuit of another upstream was opened")
+	}
+
+	if requests != 9 {
+		t.Errorf("request was sent through an open circuit, got %d requests", requests)
+	}
+}
+
+func TestUpstreamNotModified(t *testing.T) {
+	setUpstreamTestConfig()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("first"))
+	}))
+	defer server.Close()
+
+	client := newUpstreamClient()
+	response, err := client.fetch(context.Background(), "test", server.URL)
+	if err != nil || response.NotModified || string(response.Body) != "first" {
+		t.Fatalf("unexpected response %+v, err %v", response, err)
+	}
+
+	// Validators are only sent once the response was processed.
+	response, err = client.fetch(context.Background(), "test", server.URL)
+	if err != nil || response.NotModified {
+		t.Fatalf("unexpected response %+v, err %v", response, err)
+	}
+
+	client.remember(response)
+	response, err = client.fetch(context.Background(), "test", server.URL)
+	if err != nil || !response.NotModified || string(response.Body) != "first" {
+		t.Fatalf("expected the remembered body, got %+v, err %v", response, err)
+	}
+
+	client.forget(server.URL)
+	response, err = client.fetch(context.Background(), "test", server.URL)
+	if err != nil || response.NotModified {
+		t.Errorf("forgotten response was reused, got %+v, err %v", response, err)
+	}
+
+	if requests != 4 {
+		t.Errorf("expected 4 requests, got %d", requests)
+	}
+}
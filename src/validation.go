@@ -0,0 +1,146 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+)
+
+// Bounding box of Slovenia with a small margin for border crossings.
+const (
+	minLatitude  = 45.35
+	maxLatitude  = 46.95
+	minLongitude = 13.30
+	maxLongitude = 16.70
+)
+
+// QuarantinedItem is an upstream item which failed validation. Only items from the last fetch of each feed are kept.
+type QuarantinedItem struct {
+	Id          int64  `json:"-"`
+	Feed        string `json:"feed" sql:"index"`
+	ItemId      string `json:"item_id"`
+	Reason      string `json:"reason"`
+	Payload     string `json:"payload" sql:"type:text"`
+	CreatedTime int64  `json:"created"`
+}
+
+func inSlovenia(latitude float64, longitude float64) bool {
+	return latitude >= minLatitude && latitude <= maxLatitude && longitude >= minLongitude && longitude <= maxLongitude
+}
+
+// validateEvent returns the reason the event can't be used or an empty string for valid events.
+func validateEvent(event Dogodek) string {
+	switch {
+	case len(event.Id) == 0:
+		return "missing id"
+	case !inSlovenia(event.Y_wgs, event.X_wgs):
+		return fmt.Sprintf("coordinates %f, %f outside of Slovenia", event.Y_wgs, event.X_wgs)
+	case len(event.Opis) == 0 && len(event.Vzrok) == 0:
+		return "missing description"
+	case event.UpdatedTime.IsZero() || event.UpdatedTime.Before(time.Unix(0, 0)):
+		return "missing update time"
+	case !event.VeljavnostOdTime.IsZero() && !event.VeljavnostDoTime.IsZero() && event.VeljavnostDoTime.Before(event.VeljavnostOdTime):
+		return "validity ends before it starts"
+	}
+
+	return ""
+}
+
+// validateCamera returns the reason the camera can't be used or an empty string for valid cameras.
+func validateCamera(camera Camera) string {
+	switch {
+	case len(camera.LocationId) == 0:
+		return "missing location id"
+	case len(camera.ImageURL) == 0:
+		return "missing image"
+	case !inSlovenia(camera.Y_wgs, camera.X_wgs):
+		return fmt.Sprintf("coordinates %f, %f outside of Slovenia", camera.Y_wgs, camera.X_wgs)
+	}
+
+	return ""
+}
+
+// anomalyGuard rejects fetches which differ too much from the last accepted one. A real change is
+// accepted after guard.maxRejections fetches in a row confirmed it.
+type anomalyGuard struct {
+	lock       sync.Mutex
+	accepted   map[string]int
+	rejections map[string]int
+}
+
+var guard = anomalyGuard{accepted: make(map[string]int), rejections: make(map[string]int)}
+
+// check decides whether a fetch of feed with total items of which valid passed validation can replace the last one.
+func (g *anomalyGuard) check(feed string, total int, valid int, minItems int) error {
+	config := GetConfiguration().Guard
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	var err error
+	previous, hasPrevious := g.accepted[feed]
+	switch {
+	case valid < minItems:
+		err = fmt.Errorf("%s: only %d valid items, expected at least %d", feed, valid, minItems)
+	case total > 0 && float64(total-valid)/float64(total) > config.MaxInvalid:
+		err = fmt.Errorf("%s: %d of %d items are invalid", feed, total-valid, total)
+	case hasPrevious && float64(previous-valid)/float64(previous) > config.MaxDrop:
+		err = fmt.Errorf("%s: number of items dropped from %d to %d", feed, previous, valid)
+	}
+
+	if err != nil && g.rejections[feed] < config.MaxRejections {
+		g.rejections[feed]++
+		UpdateStatistics(func(s *Statistics) { s.AnomalousFetches++ })
+		sentry.CaptureMessage(err.Error())
+		log.WithFields(log.Fields{"feed": feed, "err": err, "rejections": g.rejections[feed]}).Error("Rejecting anomalous fetch.")
+		return err
+	}
+
+	// Rejections are only reset by a normal fetch, so a persisting anomaly keeps being accepted.
+	if err != nil {
+		log.WithFields(log.Fields{"feed": feed, "err": err}).Warn("Anomaly persisted, accepting it.")
+	} else {
+		g.rejections[feed] = 0
+	}
+
+	g.accepted[feed] = valid
+	return nil
+}
+
+// quarantine replaces quarantined items of the feed with ones from the latest fetch.
+func quarantine(db *gorm.DB, feed string, items []QuarantinedItem) error {
+	if len(items) > 0 {
+		UpdateStatistics(func(s *Statistics) { s.QuarantinedItems += len(items) })
+		log.WithFields(log.Fields{"feed": feed, "items": items}).Warn(len(items), " items quarantined.")
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("feed = ?", feed).Delete(&QuarantinedItem{}).Error; err != nil {
+			return err
+		}
+
+		for i := range items {
+			if err := tx.Create(&items[i]).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func newQuarantinedItem(feed string, id string, reason string, item interface{}) QuarantinedItem {
+	payload, _ := json.Marshal(item)
+	return QuarantinedItem{
+		Feed:        feed,
+		ItemId:      id,
+		Reason:      reason,
+		Payload:     string(payload),
+		CreatedTime: time.Now().Unix(),
+	}
+}
@@ -0,0 +1,72 @@
+package src
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateEvent(t *testing.T) {
+	now := time.Now()
+	valid := Dogodek{Id: "a", Y_wgs: 46.05, X_wgs: 14.5, Vzrok: "Nesreča", UpdatedTime: now}
+	tests := []struct {
+		name   string
+		modify func(event *Dogodek)
+		valid  bool
+	}{
+		{"valid", func(event *Dogodek) {}, true},
+		{"only description", func(event *Dogodek) { event.Vzrok, event.Opis = "", "Zastoj pred Vrhniko" }, true},
+		{"missing id", func(event *Dogodek) { event.Id = "" }, false},
+		{"outside of Slovenia", func(event *Dogodek) { event.Y_wgs, event.X_wgs = 48.2, 16.37 }, false},
+		{"zero coordinates", func(event *Dogodek) { event.Y_wgs, event.X_wgs = 0, 0 }, false},
+		{"missing description", func(event *Dogodek) { event.Vzrok = "" }, false},
+		{"missing update time", func(event *Dogodek) { event.UpdatedTime = time.Time{} }, false},
+		{"validity ends before it starts", func(event *Dogodek) {
+			event.VeljavnostOdTime, event.VeljavnostDoTime = now, now.Add(-time.Hour)
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event := valid
+			test.modify(&event)
+			if reason := validateEvent(event); (len(reason) == 0) != test.valid {
+				t.Errorf("expected valid %v, got reason %q", test.valid, reason)
+			}
+		})
+	}
+}
+
+func TestAnomalyGuard(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Guard.MaxDrop = 0.5
+	cfg.Guard.MaxInvalid = 0.2
+	cfg.Guard.MaxRejections = 2
+	SetConfiguration(cfg)
+
+	g := anomalyGuard{accepted: make(map[string]int), rejections: make(map[string]int)}
+	steps := []struct {
+		name     string
+		total    int
+		valid    int
+		accepted bool
+	}{
+		{"first fetch", 100, 100, true},
+		{"too few items", 0, 0, false},
+		{"too many invalid", 100, 70, false},
+		{"anomaly persisted", 100, 40, true},
+		{"recovery", 100, 90, true},
+		{"drop", 40, 40, false},
+		{"small drop", 50, 50, true},
+	}
+
+	for _, step := range steps {
+		err := g.check("events", step.total, step.valid, 1)
+		if (err == nil) != step.accepted {
+			t.Fatalf("%s: expected accepted %v, got %v", step.name, step.accepted, err)
+		}
+	}
+
+	if err := g.check("cameras", 10, 10, 1); err != nil {
+		t.Errorf("feeds aren't checked separately: %v", err)
+	}
+}